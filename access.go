@@ -0,0 +1,89 @@
+package main
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// clientAddr returns the IP address of the client of a request. If the peer
+// is a trusted proxy, the forwarding headers are followed from the right,
+// skipping further trusted proxies, as entries left of the last untrusted hop
+// can be forged by the client. X-Real-IP is used if X-Forwarded-For is absent.
+func clientAddr(r *http.Request, cfg *config) (netip.Addr, bool) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	addr = addr.Unmap()
+	if !cfg.trustedProxy(addr) {
+		return addr, true
+	}
+
+	var hops []string
+	for _, forwarded := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(forwarded, ",")...)
+	}
+	if len(hops) == 0 {
+		hops = r.Header.Values("X-Real-IP")
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			return netip.Addr{}, false
+		}
+		addr = hop.Unmap()
+		// PANASONIC_TRUST_PROXY only trusts the immediate peer.
+		if cfg.trustProxy || !cfg.trustedProxy(addr) {
+			break
+		}
+	}
+	return addr, true
+}
+
+// trustedProxy reports whether the forwarding headers set by a peer are used.
+func (cfg *config) trustedProxy(addr netip.Addr) bool {
+	if cfg.trustProxy {
+		return true
+	}
+	for _, prefix := range cfg.trustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowClients restricts a handler to the clients in PANASONIC_ALLOWED_CIDRS.
+// All clients are allowed if the list is empty. Allowed requests are passed on
+// untouched, so the wrapped handler still negotiates the exposition format.
+func allowClients(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cfg := currentConfig()
+		if len(cfg.allowedCIDRs) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		addr, ok := clientAddr(r, cfg)
+		if ok {
+			for _, prefix := range cfg.allowedCIDRs {
+				if prefix.Contains(addr) {
+					next.ServeHTTP(w, r)
+					return
+				}
+			}
+		}
+		client := r.RemoteAddr
+		if ok {
+			client = addr.String()
+		}
+		log.Printf("Warning: denied access to %s from %s.", r.URL.Path, client)
+		http.Error(w, "Forbidden.", http.StatusForbidden)
+	})
+}
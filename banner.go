@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"runtime/debug"
+	"strings"
+)
+
+// logBanner logs a one-line summary of the effective configuration at startup.
+func logBanner(cfg *config) {
+	version := "unknown"
+	if info, ok := debug.ReadBuildInfo(); ok {
+		version = info.Main.Version
+	}
+
+	families := make(map[string]int)
+	for _, circuit := range cfg.powerMappings {
+		families[circuit.family()]++
+	}
+
+	features := "none"
+	if enabled := cfg.features(); len(enabled) > 0 {
+		features = strings.Join(enabled, ",")
+	}
+	log.Printf("Effective configuration: version=%s listen=%s url=%s circuits=power:%d,energy:%d,runtime:%d,virtual:%d,derived:%d features=%s",
+		version, listenAddress, redactURL(cfg.breakerBoxURL), families[familyPower], families[familyEnergy], families[familyRuntime], len(cfg.virtualCircuits), len(cfg.derivedCircuits), features)
+}
+
+// features lists the optional features enabled by the configuration.
+func (cfg *config) features() []string {
+	var features []string
+	add := func(enabled bool, name string) {
+		if enabled {
+			features = append(features, name)
+		}
+	}
+	add(cfg.staleMarkers, "stale_markers")
+	add(cfg.unreachableValue != nil, "unreachable_value")
+	add(cfg.retries > 0, fmt.Sprintf("retries:%d", cfg.retries))
+	add(cfg.replayDir != "", "replay")
+	add(cfg.minRefreshInterval > 0, "min_refresh_interval")
+	add(cfg.preflightHead, "preflight_head")
+	add(cfg.fetchJitter > 0, "fetch_jitter")
+	add(!cfg.followRedirects, "no_redirects")
+	add(len(cfg.allowedCIDRs) > 0, "allowed_cidrs")
+	add(cfg.totalPowerFactor, "total_power_factor")
+	add(cfg.httpSD, "http_sd")
+	add(cfg.haDiscovery, "ha_discovery")
+	add(cfg.graphiteAddress != "", cfg.graphiteProtocol)
+	add(cfg.otlpEndpoint != "", "otlp")
+	add(cfg.tracing, "tracing")
+	add(len(cfg.summaryFamilies) > 0, "summaries")
+	add(cfg.ewmaAlpha > 0, "ewma")
+	add(len(cfg.energyWindows) > 0, "energy_windows")
+	add(cfg.readingDate, "reading_date")
+	add(cfg.maxSeries > 0, "max_series")
+	add(cfg.debug, "debug")
+	return features
+}
+
+// redactURL hides the credentials of a URL so it can be logged. Besides the
+// user info, this covers the values of all query parameters, as devices and
+// proxies often take tokens such as ?token= or ?key= there.
+func redactURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	if u.User != nil {
+		u.User = url.User("REDACTED")
+	}
+	if u.RawQuery != "" {
+		query := u.Query()
+		for key := range query {
+			query[key] = []string{"REDACTED"}
+		}
+		u.RawQuery = query.Encode()
+	}
+	return u.String()
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Supported circuit metric types.
+const (
+	typeGauge    = "gauge"
+	typeCounter  = "counter"
+	typeDuration = "duration"
+)
+
+// Metric families circuits are exposed in.
+const (
+	familyPower   = "power"
+	familyEnergy  = "energy"
+	familyRuntime = "runtime"
+)
+
+// Supported units of duration circuits and their length in seconds.
+const (
+	unitSeconds = "seconds"
+	unitMinutes = "minutes"
+	unitHours   = "hours"
+)
+
+var durationUnits = map[string]float64{unitSeconds: 1, unitMinutes: 60, unitHours: 3600}
+
+// Physical quantities of the units of gauge and counter circuits.
+const (
+	quantityPower   = "power"
+	quantityEnergy  = "energy"
+	quantityVoltage = "voltage"
+	quantityCurrent = "current"
+)
+
+// measurementUnit is a unit of a gauge or counter circuit's value.
+type measurementUnit struct {
+	quantity string
+	// scale is the size of the unit in its quantity's base unit, e.g. 1000
+	// for kW in W.
+	scale float64
+}
+
+// measurementUnits are the supported units of gauge and counter circuits.
+var measurementUnits = map[string]measurementUnit{
+	"mW": {quantityPower, 1e-3}, "W": {quantityPower, 1}, "kW": {quantityPower, 1e3}, "MW": {quantityPower, 1e6},
+	"mWh": {quantityEnergy, 1e-3}, "Wh": {quantityEnergy, 1}, "kWh": {quantityEnergy, 1e3}, "MWh": {quantityEnergy, 1e6},
+	"mV": {quantityVoltage, 1e-3}, "V": {quantityVoltage, 1}, "kV": {quantityVoltage, 1e3},
+	"mA": {quantityCurrent, 1e-3}, "A": {quantityCurrent, 1}, "kA": {quantityCurrent, 1e3},
+}
+
+// baseUnits are the units values are converted to by default.
+var baseUnits = map[string]string{quantityPower: "W", quantityEnergy: "Wh", quantityVoltage: "V", quantityCurrent: "A"}
+
+// circuitConfig describes how a single circuit is read from the data row.
+// In PANASONIC_MAPPINGS it is either a bare column index or an object
+// such as {"column": 6, "parser": "bcd"}.
+type circuitConfig struct {
+	// Template names an entry of PANASONIC_MAPPING_TEMPLATES the circuit
+	// inherits its settings from.
+	Template string `json:"template"`
+
+	Column int    `json:"column"`
+	Parser string `json:"parser"`
+
+	// Type is "gauge" for instantaneous power readings, "counter" for
+	// cumulative energy registers, which are exposed as an energy counter, or
+	// "duration" for runtimes in Unit, which are exposed in seconds. Gauge
+	// and counter values in Unit are converted to OutputUnit, which must be
+	// the base unit their metric is named after, W or Wh.
+	Type       string `json:"type"`
+	Unit       string `json:"unit"`
+	OutputUnit string `json:"output_unit"`
+
+	// Signed exempts a circuit from PANASONIC_NEGATIVE_POLICY, for
+	// measurements that can legitimately be negative.
+	Signed bool `json:"signed"`
+
+	// TrailingSign makes the decimal and float parsers accept a sign after
+	// the number, e.g. "123-" for -123, as reported by some devices.
+	TrailingSign bool `json:"trailing_sign"`
+
+	// Separators lists characters stripped from hex and BCD fields before
+	// decoding, e.g. "-" for fields formatted like "12-34".
+	Separators string `json:"separators"`
+
+	// Bits is the width of the two's complement values decoded by the hex
+	// parser, 16 by default.
+	Bits int `json:"bits"`
+
+	// Mantissa and Exponent locate the bit fields of the "scaled" parser,
+	// whose value is Mantissa × 10^Exponent.
+	Mantissa bitField `json:"mantissa"`
+	Exponent bitField `json:"exponent"`
+
+	// ZeroIsMissing skips the circuit when its raw value is exactly zero, for
+	// channels that report zero when no sensor is connected.
+	ZeroIsMissing bool `json:"zero_is_missing"`
+
+	// Divisor scales the parsed value down, e.g. 10 for a device reporting deciwatts.
+	Divisor *float64 `json:"divisor"`
+
+	// Thresholds are alerting thresholds in Watts, exposed so alerting rules
+	// can reference them instead of duplicating them.
+	Thresholds circuitThresholds `json:"thresholds"`
+
+	// Range is the plausible range of the circuit's value, exposed as a
+	// health signal.
+	Range circuitRange `json:"range"`
+
+	// MaxAge is how long the circuit's value may stay unchanged before the
+	// circuit is considered stale, e.g. "15m". maxAge is its parsed value.
+	MaxAge string `json:"max_age"`
+	maxAge time.Duration
+
+	// quantity is what a gauge measures if not power. It is only set for the
+	// voltage and current inputs of derived circuits, which are not exposed.
+	quantity string
+}
+
+// circuitRange holds the optional plausible minimum and maximum of a circuit.
+type circuitRange struct {
+	Min *float64 `json:"min"`
+	Max *float64 `json:"max"`
+}
+
+// contains reports whether value lies within the range, bounds included.
+func (r circuitRange) contains(value float64) bool {
+	return (r.Min == nil || value >= *r.Min) && (r.Max == nil || value <= *r.Max)
+}
+
+// configured reports whether any bound is set.
+func (r circuitRange) configured() bool {
+	return r.Min != nil || r.Max != nil
+}
+
+// bitField is a field of Width bits starting at bit Offset, counted from the
+// least significant bit.
+type bitField struct {
+	Offset int `json:"offset"`
+	Width  int `json:"width"`
+}
+
+// extract returns the field's bits of raw.
+func (b bitField) extract(raw uint64) uint64 {
+	return raw >> b.Offset & (1<<b.Width - 1)
+}
+
+// validate checks that the field lies within 64 bits.
+func (b bitField) validate() error {
+	if b.Offset < 0 || b.Width <= 0 || b.Offset+b.Width > 64 {
+		return fmt.Errorf("bit field with offset %d and width %d must lie within 64 bits", b.Offset, b.Width)
+	}
+	return nil
+}
+
+// overlaps reports whether the fields share any bits.
+func (b bitField) overlaps(o bitField) bool {
+	return b.Offset < o.Offset+o.Width && o.Offset < b.Offset+b.Width
+}
+
+// circuitThresholds holds the optional warning and critical thresholds of a circuit.
+type circuitThresholds struct {
+	Warn *float64 `json:"warn"`
+	Crit *float64 `json:"crit"`
+}
+
+// UnmarshalJSON accepts either a bare column index or a full circuit object.
+func (cc *circuitConfig) UnmarshalJSON(data []byte) error {
+	if !bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) {
+		return json.Unmarshal(data, &cc.Column)
+	}
+	return json.Unmarshal(data, (*plainCircuit)(cc))
+}
+
+// parseCircuit parses a mapping, starting from its template if it names one.
+// Settings of the circuit override those of the template. On error, the
+// circuit holds what could be decoded, so its family can still be told.
+func parseCircuit(data json.RawMessage, templates map[string]circuitConfig) (circuitConfig, error) {
+	var cc circuitConfig
+	var templateErr error
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) {
+		var ref struct {
+			Template string `json:"template"`
+		}
+		if err := json.Unmarshal(data, &ref); err != nil {
+			return cc, err
+		}
+		if ref.Template != "" {
+			if template, ok := templates[ref.Template]; ok {
+				cc = template.clone()
+			} else {
+				templateErr = fmt.Errorf("unknown template %q", ref.Template)
+			}
+		}
+	}
+	if err := json.Unmarshal(data, &cc); err != nil {
+		return cc, err
+	}
+	return cc, templateErr
+}
+
+// clone returns a copy of the circuit that shares no pointers with it, so
+// decoding into the copy cannot modify the original.
+func (cc circuitConfig) clone() circuitConfig {
+	cc.Divisor = cloneFloat(cc.Divisor)
+	cc.Thresholds.Warn = cloneFloat(cc.Thresholds.Warn)
+	cc.Thresholds.Crit = cloneFloat(cc.Thresholds.Crit)
+	cc.Range.Min = cloneFloat(cc.Range.Min)
+	cc.Range.Max = cloneFloat(cc.Range.Max)
+	return cc
+}
+
+// cloneFloat returns a pointer to a copy of *f, or nil if f is nil.
+func cloneFloat(f *float64) *float64 {
+	if f == nil {
+		return nil
+	}
+	v := *f
+	return &v
+}
+
+// family returns the metric family the circuit is exposed in. It can be
+// called before validate.
+func (cc *circuitConfig) family() string {
+	switch cc.Type {
+	case typeCounter:
+		return familyEnergy
+	case typeDuration:
+		return familyRuntime
+	}
+	return familyPower
+}
+
+// validate checks the circuit configuration and fills in defaults.
+func (cc *circuitConfig) validate() error {
+	if cc.Column < 0 {
+		return fmt.Errorf("column index %d must not be negative", cc.Column)
+	}
+	switch cc.Parser {
+	case "":
+		cc.Parser = parserHex
+		fallthrough
+	case parserHex, parserBCD, parserDecimal, parserFloat:
+		if cc.Mantissa != (bitField{}) || cc.Exponent != (bitField{}) {
+			return fmt.Errorf("mantissa and exponent are only supported with the %q parser", parserScaled)
+		}
+	case parserScaled:
+		if err := cc.Mantissa.validate(); err != nil {
+			return fmt.Errorf("invalid mantissa: %w", err)
+		}
+		if err := cc.Exponent.validate(); err != nil {
+			return fmt.Errorf("invalid exponent: %w", err)
+		}
+		if cc.Mantissa.overlaps(cc.Exponent) {
+			return errors.New("mantissa and exponent bit fields overlap")
+		}
+	default:
+		return fmt.Errorf("unknown parser %q", cc.Parser)
+	}
+	switch cc.Type {
+	case "":
+		cc.Type = typeGauge
+	case typeGauge, typeCounter, typeDuration:
+	default:
+		return fmt.Errorf("unknown type %q, must be %q, %q or %q", cc.Type, typeGauge, typeCounter, typeDuration)
+	}
+	if cc.Type == typeDuration {
+		if cc.Unit == "" {
+			cc.Unit = unitSeconds
+		}
+		if _, ok := durationUnits[cc.Unit]; !ok {
+			return fmt.Errorf("unknown unit %q, must be %q, %q or %q", cc.Unit, unitSeconds, unitMinutes, unitHours)
+		}
+		if cc.OutputUnit != "" {
+			return fmt.Errorf("output_unit is not supported on %q circuits, which are exposed in seconds", typeDuration)
+		}
+	} else if err := cc.validateUnits(); err != nil {
+		return err
+	}
+	if cc.Parser == parserHex {
+		if cc.Bits == 0 {
+			cc.Bits = 16
+		}
+		if cc.Bits < 1 || cc.Bits > 64 {
+			return fmt.Errorf("bits must be between 1 and 64, got %d", cc.Bits)
+		}
+	} else if cc.Bits != 0 {
+		return fmt.Errorf("bits is only supported with the %q parser", parserHex)
+	}
+	if cc.TrailingSign && cc.Parser != parserDecimal && cc.Parser != parserFloat {
+		return fmt.Errorf("trailing_sign is only supported with the %q and %q parsers", parserDecimal, parserFloat)
+	}
+	if cc.Separators != "" {
+		if cc.Parser != parserHex && cc.Parser != parserBCD {
+			return fmt.Errorf("separators are only supported with the %q and %q parsers", parserHex, parserBCD)
+		}
+		if strings.Trim(cc.Separators, "-: ") != "" {
+			return fmt.Errorf("separators %q may only contain '-', ':' and ' '", cc.Separators)
+		}
+	}
+	if cc.Range.Min != nil && cc.Range.Max != nil && *cc.Range.Min > *cc.Range.Max {
+		return fmt.Errorf("range minimum %g is greater than its maximum %g", *cc.Range.Min, *cc.Range.Max)
+	}
+	if cc.MaxAge != "" {
+		maxAge, err := time.ParseDuration(cc.MaxAge)
+		if err != nil {
+			return fmt.Errorf("could not parse max_age: %w", err)
+		}
+		if maxAge <= 0 {
+			return fmt.Errorf("max_age must be positive, got %q", cc.MaxAge)
+		}
+		cc.maxAge = maxAge
+	}
+	if cc.Divisor != nil && *cc.Divisor == 0 {
+		return errors.New("divisor must not be zero")
+	}
+	if cc.Type != typeGauge && (cc.Thresholds.Warn != nil || cc.Thresholds.Crit != nil) {
+		return fmt.Errorf("thresholds are only supported on %q circuits", typeGauge)
+	}
+	return nil
+}
+
+// validateUnits checks the units of a gauge or counter circuit and defaults
+// the output unit to the base unit of the quantity. Gauges are exposed in
+// Watts and counters in Watt-hours, so their values must be given in power
+// and energy units respectively, and can only be converted to the unit
+// their metric is named after.
+func (cc *circuitConfig) validateUnits() error {
+	quantity := quantityPower
+	switch {
+	case cc.Type == typeCounter:
+		quantity = quantityEnergy
+	case cc.quantity != "":
+		quantity = cc.quantity
+	}
+	if cc.Unit == "" {
+		if cc.OutputUnit != "" {
+			return errors.New("output_unit requires unit")
+		}
+		return nil
+	}
+	unit, ok := measurementUnits[cc.Unit]
+	if !ok {
+		return fmt.Errorf("unknown unit %q", cc.Unit)
+	}
+	if unit.quantity != quantity {
+		return fmt.Errorf("unit %q of %s is not supported on %q circuits, which measure %s", cc.Unit, unit.quantity, cc.Type, quantity)
+	}
+	if cc.OutputUnit == "" {
+		cc.OutputUnit = baseUnits[quantity]
+	}
+	if cc.OutputUnit != baseUnits[quantity] {
+		return fmt.Errorf("output_unit must be %q, the unit %q circuits are exposed in, got %q", baseUnits[quantity], cc.Type, cc.OutputUnit)
+	}
+	return nil
+}
+
+// unitScale returns the factor converting a value in the circuit's unit to
+// the unit it is exposed in.
+func (cc circuitConfig) unitScale() float64 {
+	if cc.Type == typeDuration {
+		return durationUnits[cc.Unit]
+	}
+	if cc.Unit == "" {
+		return 1
+	}
+	return measurementUnits[cc.Unit].scale / measurementUnits[cc.OutputUnit].scale
+}
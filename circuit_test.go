@@ -0,0 +1,37 @@
+package main
+
+import "testing"
+
+func TestValidateUnits(t *testing.T) {
+	tests := []struct {
+		name           string
+		cc             circuitConfig
+		wantOutputUnit string
+		wantErr        bool
+	}{
+		{name: "no unit", cc: circuitConfig{Type: typeGauge}},
+		{name: "output unit without unit", cc: circuitConfig{Type: typeGauge, OutputUnit: "W"}, wantErr: true},
+		{name: "gauge in kW", cc: circuitConfig{Type: typeGauge, Unit: "kW"}, wantOutputUnit: "W"},
+		{name: "gauge in W to W", cc: circuitConfig{Type: typeGauge, Unit: "W", OutputUnit: "W"}, wantOutputUnit: "W"},
+		{name: "gauge to kW", cc: circuitConfig{Type: typeGauge, Unit: "W", OutputUnit: "kW"}, wantErr: true},
+		{name: "gauge in energy unit", cc: circuitConfig{Type: typeGauge, Unit: "kWh"}, wantErr: true},
+		{name: "counter in kWh", cc: circuitConfig{Type: typeCounter, Unit: "kWh"}, wantOutputUnit: "Wh"},
+		{name: "counter to kWh", cc: circuitConfig{Type: typeCounter, Unit: "Wh", OutputUnit: "kWh"}, wantErr: true},
+		{name: "counter in power unit", cc: circuitConfig{Type: typeCounter, Unit: "W"}, wantErr: true},
+		{name: "unknown unit", cc: circuitConfig{Type: typeGauge, Unit: "hp"}, wantErr: true},
+		{name: "voltage in mV", cc: circuitConfig{Type: typeGauge, Unit: "mV", quantity: quantityVoltage}, wantOutputUnit: "V"},
+		{name: "current in power unit", cc: circuitConfig{Type: typeGauge, Unit: "W", quantity: quantityCurrent}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cc := tt.cc
+			err := cc.validateUnits()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("validateUnits() error = %v, want error %t", err, tt.wantErr)
+			}
+			if !tt.wantErr && cc.OutputUnit != tt.wantOutputUnit {
+				t.Errorf("validateUnits() output unit = %q, want %q", cc.OutputUnit, tt.wantOutputUnit)
+			}
+		})
+	}
+}
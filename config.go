@@ -0,0 +1,893 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/netip"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/joho/godotenv"
+	"go.yaml.in/yaml/v2"
+)
+
+// envFile is the optional file the configuration is loaded from, relative to
+// the working directory.
+const envFile = ".env"
+
+// config holds the effective exporter configuration. It is loaded from
+// environment variables and replaced as a whole when the configuration is reloaded.
+type config struct {
+	// fileModTime is the modification time of the .env file the configuration
+	// was loaded from. It is zero if the configuration came purely from the environment.
+	fileModTime time.Time
+
+	// hash identifies the configuration variables, to spot differently
+	// configured exporters across a fleet.
+	hash string
+
+	breakerBoxURL string
+
+	// replayDir is a directory of CSV files served in sequence instead of
+	// fetching from breakerBoxURL. The replay advances every replayInterval,
+	// or on every scrape if it is zero, and starts over at the end if
+	// replayLoop is set.
+	replayDir      string
+	replayInterval time.Duration
+	replayLoop     bool
+
+	powerMappings map[string]circuitConfig
+	staleMarkers  bool
+	warmupScrapes int
+
+	// skipRows is the number of records skipped before searching for the header row.
+	skipRows int
+
+	// headerSearchLimit is the number of records searched for the header row
+	// after the skipped ones. Zero searches all records.
+	headerSearchLimit int
+
+	// firmwareField or firmwareURL configure where the device firmware
+	// version is read from. Both are unset if it is not exposed.
+	firmwareField *firmwareField
+	firmwareURL   string
+
+	// decimalSeparator is the decimal separator of values read by the float
+	// parser.
+	decimalSeparator string
+
+	// energyUnit is the unit counter circuits are exposed in.
+	energyUnit string
+
+	// skipBadRecords skips CSV records with malformed quotes instead of
+	// failing the scrape.
+	skipBadRecords bool
+
+	// rowSelect is the mode of selecting the data row after the header row.
+	// In key-column selection, the row whose keyColumn holds keyValue is
+	// selected, with keyDupPolicy deciding between several matching rows.
+	rowSelect    string
+	keyColumn    int
+	keyValue     string
+	keyDupPolicy string
+
+	// configWarnings lists likely mistakes found in the mappings that do not
+	// make the configuration invalid.
+	configWarnings []string
+
+	// virtualCircuits maps the key of each virtual circuit to the weights of
+	// the physical circuits it is summed from.
+	virtualCircuits map[string]map[string]float64
+
+	// derivedCircuits maps the key of each derived circuit to the circuits
+	// its apparent and reactive power are computed from.
+	derivedCircuits map[string]derivedCircuit
+
+	// totalPowerFactor enables the whole-panel power factor computed from
+	// the derived circuits.
+	totalPowerFactor bool
+
+	// friendlyPrefix is prepended to friendly names derived from keys that
+	// start with a digit.
+	friendlyPrefix string
+
+	// friendlyNames maps entity keys to friendly names that override the
+	// derived ones, loaded from PANASONIC_FRIENDLY_NAMES_FILE.
+	friendlyNames map[string]string
+
+	// timeout bounds a whole fetch including retries, while attemptTimeout
+	// bounds each single attempt. Zero means no limit.
+	timeout        time.Duration
+	attemptTimeout time.Duration
+
+	// minRefreshInterval is how long a downloaded response is reused before
+	// fetching again. Zero fetches on every scrape.
+	minRefreshInterval time.Duration
+
+	// latencyWindow is the number of recent fetches the latency percentile
+	// is computed over. Zero disables it.
+	latencyWindow int
+
+	// shutdownDrain is how long the cached data keeps being served after a
+	// shutdown signal before the server stops.
+	shutdownDrain time.Duration
+
+	// retries is the number of times a failed fetch is retried, waiting
+	// retryBackoff before the first retry and doubling it for each further one.
+	// Only transport errors and the status codes in retryStatusCodes are
+	// retried; a nil set means all 5xx codes. retryJitter randomizes the delays.
+	retries          int
+	retryBackoff     time.Duration
+	retryStatusCodes map[int]bool
+	retryJitter      string
+
+	// followRedirects controls whether redirects of the breaker box are followed.
+	followRedirects bool
+
+	// allowedCIDRs restricts access to /metrics if not empty. The client
+	// address is taken from the forwarding headers instead of the connection
+	// if the peer is in trustedProxies, or for any peer with trustProxy.
+	allowedCIDRs   []netip.Prefix
+	trustProxy     bool
+	trustedProxies []netip.Prefix
+
+	// protectLandingPage applies allowedCIDRs to the landing page as well.
+	protectLandingPage bool
+
+	// httpSD enables the /targets service discovery endpoint.
+	httpSD bool
+
+	// haDiscovery enables the /ha-discovery Home Assistant sensor endpoint.
+	haDiscovery bool
+
+	// preflightHead enables revalidating the cached response with a HEAD
+	// request and If-Modified-Since before downloading it again.
+	preflightHead bool
+
+	// scrapeIntervalHint is the scrape interval assumed by windowed computations.
+	scrapeIntervalHint time.Duration
+
+	// fetchJitter is the upper bound of the random delay before each fetch.
+	fetchJitter time.Duration
+
+	// negativePolicy decides what happens to negative values of circuits
+	// that are not signed.
+	negativePolicy string
+
+	// unreachableValue is emitted for every circuit on a failed scrape.
+	// It is nil when PANASONIC_UNREACHABLE_VALUE is unset, so nothing is emitted.
+	unreachableValue *float64
+
+	// graphiteAddress enables pushing circuit values to Graphite or StatsD
+	// every graphiteInterval when set.
+	graphiteAddress  string
+	graphiteProtocol string
+	graphitePrefix   string
+	graphiteInterval time.Duration
+
+	// otlpEndpoint enables pushing circuit values to an OTLP/HTTP metrics
+	// endpoint every otlpInterval when set.
+	otlpEndpoint string
+	otlpInterval time.Duration
+
+	// tracing enables exporting a trace of every scrape to the OTLP/HTTP
+	// traces endpoint tracingEndpoint.
+	tracing         bool
+	tracingEndpoint string
+
+	// readingDate enables the calendar date info metric of the reading.
+	readingDate bool
+
+	// maxSeries caps the number of series emitted per scrape. Zero means no limit.
+	maxSeries int
+
+	// debug enables debugging aids such as dumping the raw response to
+	// debugDumpFile, either after every scrape or only after failed ones
+	// with dumpOnFailure. Up to debugDumpKeep dumps are retained.
+	debug         bool
+	debugDumpFile string
+	dumpOnFailure bool
+	debugDumpKeep int
+
+	// maintenance is the maintenance state until it is set through the
+	// /maintenance endpoint.
+	maintenance bool
+
+	// eventsSize is the number of recent scrape events kept for the /events
+	// endpoint. Zero disables recording them.
+	eventsSize int
+
+	// hysteresis is the change in Watts a power value has to exceed before
+	// the emitted value is updated. Zero disables it.
+	hysteresis float64
+
+	// stateFile persists the state of the windowed computations across
+	// restarts, saved every stateInterval.
+	stateFile     string
+	stateInterval time.Duration
+
+	// ewmaAlpha is the smoothing factor of the moving average of the power.
+	// Zero disables it.
+	ewmaAlpha float64
+
+	// energyWindows are the windows over which the energy consumed by each
+	// counter circuit is exposed.
+	energyWindows []energyWindow
+
+	// summaryFamilies lists the metric families that are additionally recorded
+	// into a Summary, using summaryObjectives as its quantile objectives.
+	summaryFamilies   map[string]bool
+	summaryObjectives map[float64]float64
+}
+
+// Supported units of the energy counters.
+const (
+	energyUnitWattHours     = "watt_hours"
+	energyUnitKilowattHours = "kilowatt_hours"
+)
+
+// maxFetchJitter bounds PANASONIC_FETCH_JITTER so the delay cannot eat up
+// a significant part of the Prometheus scrape timeout.
+const maxFetchJitter = 5 * time.Second
+
+// defaultSummaryObjectives are used when PANASONIC_SUMMARY_OBJECTIVES is unset.
+var defaultSummaryObjectives = map[float64]float64{0.5: 0.05, 0.9: 0.01, 0.99: 0.001}
+
+var (
+	// liveConfig is the configuration currently in use. Readers must load it
+	// once per operation so they see a consistent snapshot across a reload.
+	liveConfig atomic.Pointer[config]
+
+	// reloadMutex serializes configuration reloads.
+	reloadMutex sync.Mutex
+
+	// envFileKeys records which variables were set from the .env file, so a
+	// reload can update or remove them without touching the real process environment.
+	envFileKeys = make(map[string]bool)
+)
+
+// currentConfig returns the configuration currently in use.
+func currentConfig() *config {
+	return liveConfig.Load()
+}
+
+// reloadConfig re-reads the .env file and the environment and atomically
+// swaps the live configuration. The live configuration is left untouched if
+// the new one is invalid.
+func reloadConfig() error {
+	reloadMutex.Lock()
+	defer reloadMutex.Unlock()
+
+	if err := loadEnvFile(); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("could not read %s: %w", envFile, err)
+	}
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	liveConfig.Store(cfg)
+	return nil
+}
+
+// reloadOnSIGHUP reloads the configuration whenever the process receives
+// SIGHUP, like a POST to /-/reload. It runs forever.
+func reloadOnSIGHUP() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		if err := reloadConfig(); err != nil {
+			log.Printf("Error: Could not reload configuration: %v", err)
+			continue
+		}
+		log.Println("Configuration reloaded.")
+	}
+}
+
+// loadEnvFile sets the variables defined in the .env file. Like godotenv.Load,
+// variables from the real process environment take precedence over the file.
+// Variables that were removed from the file since the last load are unset.
+func loadEnvFile() error {
+	values, err := godotenv.Read(envFile)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	for key := range envFileKeys {
+		if _, ok := values[key]; !ok {
+			os.Unsetenv(key)
+			delete(envFileKeys, key)
+		}
+	}
+	for key, value := range values {
+		if _, exists := os.LookupEnv(key); exists && !envFileKeys[key] {
+			continue
+		}
+		os.Setenv(key, value)
+		envFileKeys[key] = true
+	}
+	return err
+}
+
+// retryStatus reports whether a response with the given status code is retried.
+func (cfg *config) retryStatus(code int) bool {
+	if cfg.retryStatusCodes == nil {
+		return code >= 500 && code <= 599
+	}
+	return cfg.retryStatusCodes[code]
+}
+
+// remoteConfigTimeout bounds fetching the configuration from PANASONIC_CONFIG_URL.
+const remoteConfigTimeout = 30 * time.Second
+
+// loadRemoteConfig fetches the configuration from PANASONIC_CONFIG_URL, if
+// set, and sets the variables it defines. It is a JSON or YAML object mapping
+// variable names to values, where objects such as PANASONIC_MAPPINGS may be
+// given inline. It takes precedence over the .env file, but variables from
+// the real process environment still win.
+func loadRemoteConfig() error {
+	url := os.Getenv("PANASONIC_CONFIG_URL")
+	if url == "" {
+		return nil
+	}
+
+	client := &http.Client{Timeout: remoteConfigTimeout}
+	resp, err := client.Get(url)
+	if err != nil {
+		return fmt.Errorf("could not fetch configuration: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("could not fetch configuration: received non-200 status code: %s", resp.Status)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("could not read configuration: %w", err)
+	}
+
+	// YAML is a superset of JSON, so a single parser handles both formats.
+	var values map[string]interface{}
+	if err := yaml.Unmarshal(body, &values); err != nil {
+		return fmt.Errorf("could not parse configuration: %w", err)
+	}
+
+	for key, value := range values {
+		if !strings.HasPrefix(key, "PANASONIC_") {
+			return fmt.Errorf("configuration contains unknown variable %q", key)
+		}
+		var s string
+		switch v := value.(type) {
+		case string:
+			s = v
+		case map[interface{}]interface{}, []interface{}:
+			encoded, err := json.Marshal(jsonCompatible(v))
+			if err != nil {
+				return fmt.Errorf("could not encode %s: %w", key, err)
+			}
+			s = string(encoded)
+		default:
+			s = fmt.Sprint(v)
+		}
+
+		if _, exists := os.LookupEnv(key); exists && !envFileKeys[key] {
+			continue
+		}
+		os.Setenv(key, s)
+		// The variable no longer belongs to the .env file, so a reload must
+		// neither overwrite nor unset it.
+		delete(envFileKeys, key)
+	}
+	return nil
+}
+
+// jsonCompatible converts the map[interface{}]interface{} values produced by
+// the YAML parser into map[string]interface{}, which encoding/json requires.
+func jsonCompatible(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			m[fmt.Sprint(key)] = jsonCompatible(item)
+		}
+		return m
+	case []interface{}:
+		for i, item := range v {
+			v[i] = jsonCompatible(item)
+		}
+		return v
+	default:
+		return v
+	}
+}
+
+// loadConfig builds a configuration from the environment and validates it.
+func loadConfig() (*config, error) {
+	cfg := &config{
+		breakerBoxURL:  os.Getenv("PANASONIC_URL"),
+		replayDir:      os.Getenv("PANASONIC_REPLAY_DIR"),
+		friendlyPrefix: os.Getenv("PANASONIC_FRIENDLY_PREFIX"),
+		hash:           configHash(),
+	}
+	if readStdin {
+		cfg.breakerBoxURL = stdinURL
+	}
+	mappingsJSON := os.Getenv("PANASONIC_MAPPINGS")
+	if info, err := os.Stat(envFile); err == nil && len(envFileKeys) > 0 {
+		cfg.fileModTime = info.ModTime()
+	}
+
+	// A replay does not need the breaker box.
+	if (cfg.breakerBoxURL == "" && cfg.replayDir == "") || mappingsJSON == "" {
+		return nil, errors.New("PANASONIC_URL and PANASONIC_MAPPINGS must be set in the .env file or environment")
+	}
+
+	// Templates hold settings shared by several circuits.
+	var templates map[string]circuitConfig
+	if value := os.Getenv("PANASONIC_MAPPING_TEMPLATES"); value != "" {
+		if err := json.Unmarshal([]byte(value), &templates); err != nil {
+			return nil, fmt.Errorf("could not parse PANASONIC_MAPPING_TEMPLATES JSON: %w", err)
+		}
+	}
+	for name, template := range templates {
+		if template.Template != "" {
+			return nil, fmt.Errorf("template '%s' must not reference another template", name)
+		}
+	}
+
+	// Parse the circuit mappings from the JSON string.
+	var rawMappings map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(mappingsJSON), &rawMappings); err != nil {
+		return nil, fmt.Errorf("could not parse PANASONIC_MAPPINGS JSON: %w", err)
+	}
+	// Circuits of disabled families are dropped before parsing errors are
+	// reported and before validation, so their mappings can stay in place
+	// without causing errors.
+	enabled := map[string]bool{familyPower: true, familyEnergy: true, familyRuntime: true}
+	if families := envList("PANASONIC_ENABLED_FAMILIES"); families != nil {
+		enabled = make(map[string]bool)
+		for _, family := range families {
+			if family != familyPower && family != familyEnergy && family != familyRuntime {
+				return nil, fmt.Errorf("unknown metric family %q in PANASONIC_ENABLED_FAMILIES", family)
+			}
+			enabled[family] = true
+		}
+	}
+	cfg.powerMappings = make(map[string]circuitConfig, len(rawMappings))
+	for key, raw := range rawMappings {
+		circuit, err := parseCircuit(raw, templates)
+		if !enabled[circuit.family()] {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("could not parse mapping for entity '%s': %w", key, err)
+		}
+		if err := circuit.validate(); err != nil {
+			return nil, fmt.Errorf("invalid mapping for entity '%s': %w", key, err)
+		}
+		cfg.powerMappings[key] = circuit
+	}
+	dupIndexPolicy := envString("PANASONIC_DUP_INDEX_POLICY", dupIndexAllow)
+	switch dupIndexPolicy {
+	case dupIndexAllow, dupIndexWarn:
+	case dupIndexError:
+		if shared := sharedColumns(cfg.powerMappings); len(shared) > 0 {
+			return nil, fmt.Errorf("%s, which PANASONIC_DUP_INDEX_POLICY does not allow", shared[0])
+		}
+	default:
+		return nil, fmt.Errorf("PANASONIC_DUP_INDEX_POLICY must be %q, %q or %q, got %q", dupIndexAllow, dupIndexWarn, dupIndexError, dupIndexPolicy)
+	}
+	cfg.configWarnings = mappingWarnings(mappingsJSON, rawMappings, cfg.powerMappings, dupIndexPolicy)
+	logConfigWarnings(cfg.configWarnings)
+
+	// Virtual circuits are exposed as power.
+	if value := os.Getenv("PANASONIC_VIRTUAL_CIRCUITS"); value != "" && enabled[familyPower] {
+		if err := json.Unmarshal([]byte(value), &cfg.virtualCircuits); err != nil {
+			return nil, fmt.Errorf("could not parse PANASONIC_VIRTUAL_CIRCUITS JSON: %w", err)
+		}
+	}
+	for key, components := range cfg.virtualCircuits {
+		if _, ok := cfg.powerMappings[key]; ok {
+			return nil, fmt.Errorf("virtual circuit '%s' has the same key as a mapped circuit", key)
+		}
+		if len(components) == 0 {
+			return nil, fmt.Errorf("virtual circuit '%s' has no components", key)
+		}
+		for component := range components {
+			circuit, ok := cfg.powerMappings[component]
+			if !ok {
+				return nil, fmt.Errorf("virtual circuit '%s' references unknown circuit '%s'", key, component)
+			}
+			if circuit.Type != typeGauge {
+				return nil, fmt.Errorf("virtual circuit '%s' references %s circuit '%s'", key, circuit.Type, component)
+			}
+		}
+	}
+
+	// Derived circuits are computed from power, so like virtual circuits
+	// they need that family.
+	if value := os.Getenv("PANASONIC_DERIVED_CIRCUITS"); value != "" && enabled[familyPower] {
+		if err := json.Unmarshal([]byte(value), &cfg.derivedCircuits); err != nil {
+			return nil, fmt.Errorf("could not parse PANASONIC_DERIVED_CIRCUITS JSON: %w", err)
+		}
+	}
+	for key, derived := range cfg.derivedCircuits {
+		if err := derived.validate(cfg.powerMappings); err != nil {
+			return nil, fmt.Errorf("invalid derived circuit '%s': %w", key, err)
+		}
+		cfg.derivedCircuits[key] = derived
+	}
+
+	var err error
+	if cfg.totalPowerFactor, err = envBool("PANASONIC_TOTAL_POWER_FACTOR", false); err != nil {
+		return nil, err
+	}
+	// Like the derived circuits it is computed from, the total power factor
+	// is ignored without the power family.
+	cfg.totalPowerFactor = cfg.totalPowerFactor && enabled[familyPower]
+	if cfg.totalPowerFactor && len(cfg.derivedCircuits) == 0 {
+		return nil, errors.New("PANASONIC_TOTAL_POWER_FACTOR requires PANASONIC_DERIVED_CIRCUITS")
+	}
+	if cfg.staleMarkers, err = envBool("PANASONIC_STALE_MARKERS", false); err != nil {
+		return nil, err
+	}
+	cfg.negativePolicy = envString("PANASONIC_NEGATIVE_POLICY", negativeKeep)
+	switch cfg.negativePolicy {
+	case negativeKeep, negativeZero, negativeDrop:
+	default:
+		return nil, fmt.Errorf("PANASONIC_NEGATIVE_POLICY must be %q, %q or %q, got %q", negativeKeep, negativeZero, negativeDrop, cfg.negativePolicy)
+	}
+	if value := os.Getenv("PANASONIC_UNREACHABLE_VALUE"); value != "" {
+		if cfg.staleMarkers {
+			return nil, errors.New("PANASONIC_UNREACHABLE_VALUE and PANASONIC_STALE_MARKERS cannot be used together")
+		}
+		sentinel, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse PANASONIC_UNREACHABLE_VALUE: %w", err)
+		}
+		cfg.unreachableValue = &sentinel
+	}
+	if cfg.warmupScrapes, err = envInt("PANASONIC_WARMUP_SCRAPES", 0); err != nil {
+		return nil, err
+	}
+
+	if cfg.timeout, err = envDuration("PANASONIC_TIMEOUT", 0); err != nil {
+		return nil, err
+	}
+	if cfg.attemptTimeout, err = envDuration("PANASONIC_ATTEMPT_TIMEOUT", 0); err != nil {
+		return nil, err
+	}
+	if cfg.retries, err = envInt("PANASONIC_RETRIES", 0); err != nil {
+		return nil, err
+	}
+	if cfg.retryBackoff, err = envDuration("PANASONIC_RETRY_BACKOFF", 500*time.Millisecond); err != nil {
+		return nil, err
+	}
+	for _, code := range envList("PANASONIC_RETRY_STATUS") {
+		status, err := strconv.Atoi(code)
+		if err != nil || status < 100 || status > 599 {
+			return nil, fmt.Errorf("invalid HTTP status code %q in PANASONIC_RETRY_STATUS", code)
+		}
+		if cfg.retryStatusCodes == nil {
+			cfg.retryStatusCodes = make(map[int]bool)
+		}
+		cfg.retryStatusCodes[status] = true
+	}
+	cfg.retryJitter = envString("PANASONIC_RETRY_JITTER", retryJitterNone)
+	switch cfg.retryJitter {
+	case retryJitterNone, retryJitterFull, retryJitterDecorrelated:
+	default:
+		return nil, fmt.Errorf("PANASONIC_RETRY_JITTER must be %q, %q or %q, got %q", retryJitterNone, retryJitterFull, retryJitterDecorrelated, cfg.retryJitter)
+	}
+	if cfg.followRedirects, err = envBool("PANASONIC_FOLLOW_REDIRECTS", true); err != nil {
+		return nil, err
+	}
+	if cfg.allowedCIDRs, err = envPrefixes("PANASONIC_ALLOWED_CIDRS"); err != nil {
+		return nil, err
+	}
+	if cfg.trustProxy, err = envBool("PANASONIC_TRUST_PROXY", false); err != nil {
+		return nil, err
+	}
+	if cfg.trustedProxies, err = envPrefixes("PANASONIC_TRUSTED_PROXIES"); err != nil {
+		return nil, err
+	}
+	if cfg.skipBadRecords, err = envBool("PANASONIC_SKIP_BAD_RECORDS", false); err != nil {
+		return nil, err
+	}
+	if cfg.protectLandingPage, err = envBool("PANASONIC_PROTECT_LANDING_PAGE", false); err != nil {
+		return nil, err
+	}
+	if cfg.httpSD, err = envBool("PANASONIC_HTTP_SD", false); err != nil {
+		return nil, err
+	}
+	if cfg.haDiscovery, err = envBool("PANASONIC_HA_DISCOVERY", false); err != nil {
+		return nil, err
+	}
+	if cfg.preflightHead, err = envBool("PANASONIC_PREFLIGHT_HEAD", false); err != nil {
+		return nil, err
+	}
+	if cfg.skipRows, err = envInt("PANASONIC_SKIP_ROWS", 0); err != nil {
+		return nil, err
+	}
+	if cfg.headerSearchLimit, err = envInt("PANASONIC_HEADER_SEARCH_LIMIT", 0); err != nil {
+		return nil, err
+	}
+	if path := os.Getenv("PANASONIC_FRIENDLY_NAMES_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("could not read PANASONIC_FRIENDLY_NAMES_FILE: %w", err)
+		}
+		if err := json.Unmarshal(data, &cfg.friendlyNames); err != nil {
+			return nil, fmt.Errorf("could not parse PANASONIC_FRIENDLY_NAMES_FILE JSON: %w", err)
+		}
+	}
+	if cfg.minRefreshInterval, err = envDuration("PANASONIC_MIN_REFRESH_INTERVAL", 0); err != nil {
+		return nil, err
+	}
+	if cfg.shutdownDrain, err = envDuration("PANASONIC_SHUTDOWN_DRAIN", 0); err != nil {
+		return nil, err
+	}
+	if cfg.latencyWindow, err = envInt("PANASONIC_LATENCY_WINDOW", 100); err != nil {
+		return nil, err
+	}
+	if cfg.replayInterval, err = envDuration("PANASONIC_REPLAY_INTERVAL", 0); err != nil {
+		return nil, err
+	}
+	if cfg.replayLoop, err = envBool("PANASONIC_REPLAY_LOOP", true); err != nil {
+		return nil, err
+	}
+	if cfg.firmwareField, err = parseFirmwareField(os.Getenv("PANASONIC_FIRMWARE_FIELD")); err != nil {
+		return nil, err
+	}
+	cfg.firmwareURL = os.Getenv("PANASONIC_FIRMWARE_URL")
+	if cfg.firmwareField != nil && cfg.firmwareURL != "" {
+		return nil, errors.New("PANASONIC_FIRMWARE_FIELD and PANASONIC_FIRMWARE_URL cannot be used together")
+	}
+	cfg.decimalSeparator = envString("PANASONIC_DECIMAL_SEPARATOR", ".")
+	if cfg.decimalSeparator != "." && cfg.decimalSeparator != "," {
+		return nil, errors.New(`PANASONIC_DECIMAL_SEPARATOR must be "." or ","`)
+	}
+	cfg.energyUnit = envString("PANASONIC_ENERGY_UNIT", energyUnitWattHours)
+	if cfg.energyUnit != energyUnitWattHours && cfg.energyUnit != energyUnitKilowattHours {
+		return nil, fmt.Errorf("PANASONIC_ENERGY_UNIT must be %q or %q", energyUnitWattHours, energyUnitKilowattHours)
+	}
+	cfg.rowSelect = envString("PANASONIC_ROW_SELECT", rowSelectNext)
+	switch cfg.rowSelect {
+	case rowSelectNext, rowSelectNewest, rowSelectNearestPast:
+	case rowSelectKey:
+		if cfg.keyColumn, err = envInt("PANASONIC_KEY_COLUMN", 0); err != nil {
+			return nil, err
+		}
+		if cfg.keyValue = os.Getenv("PANASONIC_KEY_VALUE"); cfg.keyValue == "" {
+			return nil, errors.New("PANASONIC_KEY_VALUE must be set for key-column row selection")
+		}
+		cfg.keyDupPolicy = envString("PANASONIC_KEY_DUP_POLICY", keyDupFirst)
+		switch cfg.keyDupPolicy {
+		case keyDupFirst, keyDupLast, keyDupError:
+		default:
+			return nil, fmt.Errorf("PANASONIC_KEY_DUP_POLICY must be one of %q, %q or %q", keyDupFirst, keyDupLast, keyDupError)
+		}
+	default:
+		return nil, fmt.Errorf("PANASONIC_ROW_SELECT must be one of %q, %q, %q or %q", rowSelectNext, rowSelectNewest, rowSelectNearestPast, rowSelectKey)
+	}
+	if cfg.scrapeIntervalHint, err = envDuration("PANASONIC_SCRAPE_INTERVAL_HINT", time.Minute); err != nil {
+		return nil, err
+	}
+	if cfg.fetchJitter, err = envDuration("PANASONIC_FETCH_JITTER", 0); err != nil {
+		return nil, err
+	}
+	if cfg.fetchJitter > maxFetchJitter {
+		return nil, fmt.Errorf("PANASONIC_FETCH_JITTER must not exceed %s", maxFetchJitter)
+	}
+
+	cfg.graphiteAddress = os.Getenv("PANASONIC_GRAPHITE_ADDRESS")
+	cfg.graphiteProtocol = envString("PANASONIC_GRAPHITE_PROTOCOL", pushProtocolGraphite)
+	if cfg.graphiteProtocol != pushProtocolGraphite && cfg.graphiteProtocol != pushProtocolStatsD {
+		return nil, fmt.Errorf("PANASONIC_GRAPHITE_PROTOCOL must be %q or %q", pushProtocolGraphite, pushProtocolStatsD)
+	}
+	cfg.graphitePrefix = envString("PANASONIC_GRAPHITE_PREFIX", namespace)
+	if cfg.graphiteInterval, err = envDuration("PANASONIC_GRAPHITE_INTERVAL", time.Minute); err != nil {
+		return nil, err
+	}
+	if cfg.graphiteInterval == 0 {
+		return nil, errors.New("PANASONIC_GRAPHITE_INTERVAL must be positive")
+	}
+
+	cfg.otlpEndpoint = os.Getenv("PANASONIC_OTLP_ENDPOINT")
+	if cfg.tracing, err = envBool("PANASONIC_TRACING", false); err != nil {
+		return nil, err
+	}
+	cfg.tracingEndpoint = os.Getenv("PANASONIC_TRACING_ENDPOINT")
+	if cfg.tracing && cfg.tracingEndpoint == "" {
+		return nil, errors.New("PANASONIC_TRACING requires PANASONIC_TRACING_ENDPOINT")
+	}
+	if cfg.otlpInterval, err = envDuration("PANASONIC_OTLP_INTERVAL", time.Minute); err != nil {
+		return nil, err
+	}
+	if cfg.otlpInterval == 0 {
+		return nil, errors.New("PANASONIC_OTLP_INTERVAL must be positive")
+	}
+
+	if cfg.debug, err = envBool("PANASONIC_DEBUG", false); err != nil {
+		return nil, err
+	}
+	cfg.debugDumpFile = os.Getenv("PANASONIC_DEBUG_DUMP_FILE")
+	if cfg.dumpOnFailure, err = envBool("PANASONIC_DUMP_ON_FAILURE", false); err != nil {
+		return nil, err
+	}
+	if cfg.debugDumpKeep, err = envInt("PANASONIC_DEBUG_DUMP_KEEP", 1); err != nil {
+		return nil, err
+	}
+	if cfg.debugDumpKeep == 0 {
+		return nil, errors.New("PANASONIC_DEBUG_DUMP_KEEP must be positive")
+	}
+	if cfg.eventsSize, err = envInt("PANASONIC_EVENTS_SIZE", 50); err != nil {
+		return nil, err
+	}
+	if cfg.maintenance, err = envBool("PANASONIC_MAINTENANCE", false); err != nil {
+		return nil, err
+	}
+	if cfg.readingDate, err = envBool("PANASONIC_READING_DATE", false); err != nil {
+		return nil, err
+	}
+	if cfg.maxSeries, err = envInt("PANASONIC_MAX_SERIES", 0); err != nil {
+		return nil, err
+	}
+	cfg.stateFile = os.Getenv("PANASONIC_STATE_FILE")
+	if cfg.stateInterval, err = envDuration("PANASONIC_STATE_INTERVAL", time.Minute); err != nil {
+		return nil, err
+	}
+	if cfg.stateInterval == 0 {
+		return nil, errors.New("PANASONIC_STATE_INTERVAL must be positive")
+	}
+	if value := os.Getenv("PANASONIC_HYSTERESIS"); value != "" {
+		if cfg.hysteresis, err = strconv.ParseFloat(value, 64); err != nil {
+			return nil, fmt.Errorf("could not parse PANASONIC_HYSTERESIS: %w", err)
+		}
+		if cfg.hysteresis < 0 {
+			return nil, errors.New("PANASONIC_HYSTERESIS must not be negative")
+		}
+	}
+	if value := os.Getenv("PANASONIC_EWMA_ALPHA"); value != "" {
+		if cfg.ewmaAlpha, err = strconv.ParseFloat(value, 64); err != nil {
+			return nil, fmt.Errorf("could not parse PANASONIC_EWMA_ALPHA: %w", err)
+		}
+		if cfg.ewmaAlpha <= 0 || cfg.ewmaAlpha > 1 {
+			return nil, errors.New("PANASONIC_EWMA_ALPHA must be greater than 0 and at most 1")
+		}
+	}
+
+	for _, value := range envList("PANASONIC_ENERGY_WINDOWS") {
+		length, err := time.ParseDuration(value)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse PANASONIC_ENERGY_WINDOWS: %w", err)
+		}
+		if length <= 0 {
+			return nil, fmt.Errorf("PANASONIC_ENERGY_WINDOWS must only contain positive durations, got %q", value)
+		}
+		cfg.energyWindows = append(cfg.energyWindows, energyWindow{label: value, length: length})
+	}
+
+	cfg.summaryFamilies = make(map[string]bool)
+	for _, family := range envList("PANASONIC_SUMMARY_FAMILIES") {
+		if family != familyPower {
+			return nil, fmt.Errorf("unknown metric family %q in PANASONIC_SUMMARY_FAMILIES", family)
+		}
+		cfg.summaryFamilies[family] = true
+	}
+	cfg.summaryObjectives = defaultSummaryObjectives
+	if value := os.Getenv("PANASONIC_SUMMARY_OBJECTIVES"); value != "" {
+		if cfg.summaryObjectives, err = parseObjectives(value); err != nil {
+			return nil, fmt.Errorf("could not parse PANASONIC_SUMMARY_OBJECTIVES: %w", err)
+		}
+	}
+
+	return cfg, nil
+}
+
+// envString returns the value of an environment variable, or def when it is unset.
+func envString(name, def string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return def
+}
+
+// envInt parses a non-negative integer environment variable, returning def when it is unset.
+func envInt(name string, def int) (int, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return def, nil
+	}
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("could not parse %s: %w", name, err)
+	}
+	if i < 0 {
+		return 0, fmt.Errorf("%s must not be negative", name)
+	}
+	return i, nil
+}
+
+// envDuration parses a non-negative duration environment variable, returning def when it is unset.
+func envDuration(name string, def time.Duration) (time.Duration, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("could not parse %s: %w", name, err)
+	}
+	if d < 0 {
+		return 0, fmt.Errorf("%s must not be negative", name)
+	}
+	return d, nil
+}
+
+// envBool parses a boolean environment variable, returning def when it is unset.
+func envBool(name string, def bool) (bool, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return def, nil
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("could not parse %s: %w", name, err)
+	}
+	return b, nil
+}
+
+// envPrefixes parses a comma-separated environment variable of CIDRs.
+func envPrefixes(name string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, cidr := range envList(name) {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q in %s: %w", cidr, name, err)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// envList parses a comma-separated environment variable into its trimmed, non-empty elements.
+func envList(name string) []string {
+	var list []string
+	for _, item := range strings.Split(os.Getenv(name), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// parseObjectives parses summary objectives in the form "0.5:0.05,0.9:0.01".
+func parseObjectives(value string) (map[float64]float64, error) {
+	objectives := make(map[float64]float64)
+	for _, pair := range strings.Split(value, ",") {
+		quantile, epsilon, ok := strings.Cut(strings.TrimSpace(pair), ":")
+		if !ok {
+			return nil, fmt.Errorf("objective %q is not in the form quantile:error", pair)
+		}
+		q, err := strconv.ParseFloat(quantile, 64)
+		if err != nil || q <= 0 || q >= 1 {
+			return nil, fmt.Errorf("quantile %q must be a number between 0 and 1", quantile)
+		}
+		e, err := strconv.ParseFloat(epsilon, 64)
+		if err != nil || e <= 0 || e >= 1 {
+			return nil, fmt.Errorf("error %q must be a number between 0 and 1", epsilon)
+		}
+		objectives[q] = e
+	}
+	return objectives, nil
+}
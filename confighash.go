@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"slices"
+	"strings"
+)
+
+// configHash returns a short hash of the PANASONIC_* variables the
+// configuration was loaded from, wherever they were set. JSON values such as
+// PANASONIC_MAPPINGS are re-encoded first, so reordering their keys or
+// changing whitespace does not change the hash.
+func configHash() string {
+	var vars []string
+	for _, env := range os.Environ() {
+		name, value, _ := strings.Cut(env, "=")
+		if strings.HasPrefix(name, "PANASONIC_") && value != "" {
+			vars = append(vars, name+"="+canonicalJSON(value))
+		}
+	}
+	slices.Sort(vars)
+
+	sum := sha256.Sum256([]byte(strings.Join(vars, "\n")))
+	return hex.EncodeToString(sum[:8])
+}
+
+// canonicalJSON re-encodes a JSON object or array with sorted keys and no
+// whitespace. Other values are returned as is.
+func canonicalJSON(value string) string {
+	trimmed := bytes.TrimSpace([]byte(value))
+	if !bytes.HasPrefix(trimmed, []byte("{")) && !bytes.HasPrefix(trimmed, []byte("[")) {
+		return value
+	}
+	var decoded any
+	decoder := json.NewDecoder(bytes.NewReader(trimmed))
+	decoder.UseNumber()
+	if err := decoder.Decode(&decoded); err != nil {
+		return value
+	}
+	encoded, err := json.Marshal(decoded)
+	if err != nil {
+		return value
+	}
+	return string(encoded)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"slices"
+)
+
+// Supported policies for several circuits reading the same column.
+const (
+	dupIndexAllow = "allow"
+	dupIndexWarn  = "warn"
+	dupIndexError = "error"
+)
+
+// plainCircuit decodes a circuit object without the custom UnmarshalJSON of
+// circuitConfig, so a decoder's settings apply to it.
+type plainCircuit circuitConfig
+
+// mappingWarnings checks PANASONIC_MAPPINGS for likely mistakes that do not
+// make the configuration invalid: duplicate keys, of which only the last one
+// takes effect, and unknown fields in circuit objects, which are ignored.
+// Circuits reading the same column are only reported with the "warn"
+// PANASONIC_DUP_INDEX_POLICY, as they may be intentional aliases.
+func mappingWarnings(mappingsJSON string, rawMappings map[string]json.RawMessage, mappings map[string]circuitConfig, dupIndexPolicy string) []string {
+	var warnings []string
+	for _, key := range duplicateKeys([]byte(mappingsJSON)) {
+		warnings = append(warnings, fmt.Sprintf("entity '%s' is mapped more than once in PANASONIC_MAPPINGS, only the last mapping is used", key))
+	}
+	for key, raw := range rawMappings {
+		if err := unknownFields(raw); err != nil {
+			warnings = append(warnings, fmt.Sprintf("mapping for entity '%s' has an ignored field: %v", key, err))
+		}
+	}
+	if dupIndexPolicy == dupIndexWarn {
+		warnings = append(warnings, sharedColumns(mappings)...)
+	}
+	slices.Sort(warnings)
+	return warnings
+}
+
+// sharedColumns describes the columns read by more than one circuit, sorted.
+func sharedColumns(mappings map[string]circuitConfig) []string {
+	columns := make(map[int][]string)
+	for key, circuit := range mappings {
+		columns[circuit.Column] = append(columns[circuit.Column], key)
+	}
+	var shared []string
+	for column, keys := range columns {
+		if len(keys) > 1 {
+			slices.Sort(keys)
+			shared = append(shared, fmt.Sprintf("entities %q all read column %d", keys, column))
+		}
+	}
+	slices.Sort(shared)
+	return shared
+}
+
+// unknownFields reports the first field of a circuit object that does not
+// correspond to a setting. Bare column indices have no fields.
+func unknownFields(data json.RawMessage) error {
+	if !bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) {
+		return nil
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(new(plainCircuit))
+}
+
+// duplicateKeys returns the keys that occur more than once in a JSON object.
+// It returns nothing if data is not a valid object, which is reported elsewhere.
+func duplicateKeys(data []byte) []string {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	if token, err := decoder.Token(); err != nil || token != json.Delim('{') {
+		return nil
+	}
+	seen := make(map[string]bool)
+	var duplicates []string
+	for decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			return duplicates
+		}
+		key, _ := token.(string)
+		if seen[key] && !slices.Contains(duplicates, key) {
+			duplicates = append(duplicates, key)
+		}
+		seen[key] = true
+		var value json.RawMessage
+		if err := decoder.Decode(&value); err != nil {
+			return duplicates
+		}
+	}
+	return duplicates
+}
+
+// logConfigWarnings logs the configuration warnings found at load.
+func logConfigWarnings(warnings []string) {
+	for _, warning := range warnings {
+		log.Printf("Warning: %s.", warning)
+	}
+}
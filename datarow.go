@@ -0,0 +1,171 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+const (
+	// headerToken is the first field of the header row preceding the data.
+	headerToken = "YYYYMMDDhhmm"
+
+	// timestampLayout is the Go layout of the "YYYYMMDDhhmm" timestamp column.
+	timestampLayout = "200601021504"
+)
+
+// Supported modes of selecting the data row among the rows following the header.
+const (
+	rowSelectNext        = "next"
+	rowSelectNewest      = "newest"
+	rowSelectNearestPast = "nearest_past"
+	rowSelectKey         = "key"
+)
+
+// Supported policies when several rows match the key in key-column selection.
+const (
+	keyDupFirst = "first"
+	keyDupLast  = "last"
+	keyDupError = "error"
+)
+
+// errDuplicateKey is returned when several data rows match the key and the
+// duplicate policy is "error".
+var errDuplicateKey = errors.New("several data rows match the key")
+
+// errHeaderLimit is returned when the header row is not found within
+// PANASONIC_HEADER_SEARCH_LIMIT records.
+var errHeaderLimit = errors.New("CSV header row not found within the search limit")
+
+// findDataRow locates the header row and the data row within the parsed CSV
+// records. In time-based row selection, it also returns the number of data
+// rows left out for lacking a parseable timestamp.
+func findDataRow(cfg *config, records [][]string) (header, dataRow []string, untimestamped int, err error) {
+	// Some devices emit a fixed preamble that can confuse the header search.
+	if cfg.skipRows > 0 {
+		if cfg.skipRows >= len(records) {
+			return nil, nil, 0, fmt.Errorf("PANASONIC_SKIP_ROWS (%d) skips all %d records of the response", cfg.skipRows, len(records))
+		}
+		records = records[cfg.skipRows:]
+	}
+
+	headerIndex := -1
+
+	// To handle malformed or partial responses, we search for the specific header
+	// row ("YYYYMMDDhhmm") and assume the data is on the next line. The search
+	// can be bounded to the first records, which also catches responses whose
+	// header is unexpectedly deep.
+	searched := records
+	if cfg.headerSearchLimit > 0 && cfg.headerSearchLimit < len(records) {
+		searched = records[:cfg.headerSearchLimit]
+	}
+	for i, row := range searched {
+		if len(row) > 0 && row[0] == headerToken {
+			headerIndex = i
+			break
+		}
+	}
+
+	if headerIndex == -1 && len(searched) < len(records) {
+		return nil, nil, 0, fmt.Errorf("%w: not among the first %d records", errHeaderLimit, cfg.headerSearchLimit)
+	}
+	if headerIndex == -1 {
+		return nil, nil, 0, errors.New("CSV header row ('YYYYMMDDhhmm') not found in the response")
+	}
+	if len(records) <= headerIndex+1 {
+		return nil, nil, 0, errors.New("data row not found immediately after the header row")
+	}
+
+	if cfg.rowSelect == rowSelectNext {
+		return records[headerIndex], records[headerIndex+1], 0, nil
+	}
+
+	// The data rows of this section run until the next header row.
+	rows := records[headerIndex+1:]
+	for i, row := range rows {
+		if len(row) > 0 && row[0] == headerToken {
+			rows = rows[:i]
+			break
+		}
+	}
+	if cfg.rowSelect == rowSelectKey {
+		dataRow, err = selectRowByKey(rows, cfg.keyColumn, cfg.keyValue, cfg.keyDupPolicy)
+	} else {
+		dataRow, untimestamped, err = selectRowByTime(rows, cfg.rowSelect, time.Now())
+	}
+	if err != nil {
+		return nil, nil, untimestamped, err
+	}
+	return records[headerIndex], dataRow, untimestamped, nil
+}
+
+// selectRowByTime picks a data row by its timestamp. "newest" picks the row
+// with the latest timestamp, while "nearest_past" ignores rows dated after now,
+// such as test rows some devices emit, and picks the newest remaining one.
+// Rows without a parseable timestamp are left out and counted. Only if no row
+// has one, the first row is selected as in "next" row selection.
+func selectRowByTime(rows [][]string, mode string, now time.Time) ([]string, int, error) {
+	var selected []string
+	var selectedTime time.Time
+	var untimestamped int
+	for _, row := range rows {
+		t, err := parseReadingTime(row)
+		if err != nil {
+			untimestamped++
+			continue
+		}
+		if mode == rowSelectNearestPast && t.After(now) {
+			continue
+		}
+		if selected == nil || t.After(selectedTime) {
+			selected, selectedTime = row, t
+		}
+	}
+	if len(rows) > 0 && untimestamped == len(rows) {
+		log.Printf("Warning: no data row has a parseable timestamp, falling back to the first row for row selection mode %q.", mode)
+		return rows[0], untimestamped, nil
+	}
+	if selected == nil {
+		return nil, untimestamped, fmt.Errorf("no data row with a suitable timestamp found for row selection mode %q", mode)
+	}
+	return selected, untimestamped, nil
+}
+
+// selectRowByKey picks the data row whose key column holds the key value.
+// If several rows match, the duplicate policy decides deterministically
+// between the first one, the last one, or failing with errDuplicateKey.
+func selectRowByKey(rows [][]string, column int, value, dupPolicy string) ([]string, error) {
+	var selected []string
+	for _, row := range rows {
+		if len(row) <= column || row[column] != value {
+			continue
+		}
+		if selected != nil {
+			switch dupPolicy {
+			case keyDupError:
+				return nil, fmt.Errorf("%w %q in column %d", errDuplicateKey, value, column)
+			case keyDupFirst:
+				continue
+			}
+		}
+		selected = row
+	}
+	if selected == nil {
+		return nil, fmt.Errorf("no data row with key %q in column %d found", value, column)
+	}
+	return selected, nil
+}
+
+// parseReadingTime parses the "YYYYMMDDhhmm" timestamp in the first column of a data row.
+// The device clock has no time zone information, so it is assumed to be local time.
+func parseReadingTime(dataRow []string) (time.Time, error) {
+	if len(dataRow) == 0 {
+		return time.Time{}, errors.New("data row has no timestamp column")
+	}
+	t, err := time.ParseInLocation(timestampLayout, dataRow[0], time.Local)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("could not parse reading timestamp %q: %w", dataRow[0], err)
+	}
+	return t, nil
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Supported policies for negative values of unsigned circuits.
+const (
+	negativeKeep = "keep"
+	negativeZero = "zero"
+	negativeDrop = "drop"
+)
+
+// Supported parser modes for circuit values.
+const (
+	parserHex     = "hex"
+	parserBCD     = "bcd"
+	parserDecimal = "decimal"
+	parserFloat   = "float"
+	parserScaled  = "scaled"
+)
+
+// readCircuit decodes and scales the value of a circuit from the data row.
+// On failure, it also returns the parse warning type describing the problem.
+func readCircuit(cfg *config, dataRow []string, key string, circuit circuitConfig) (float64, string, error) {
+	if len(dataRow) <= circuit.Column {
+		return 0, warningOutOfBounds, fmt.Errorf("column index %d for entity '%s' is out of bounds", circuit.Column, key)
+	}
+	// Fields padded with whitespace only are empty too.
+	if strings.TrimSpace(dataRow[circuit.Column]) == "" {
+		return 0, warningEmptyField, fmt.Errorf("column %d for entity '%s' is empty", circuit.Column, key)
+	}
+
+	value, err := decodeValue(dataRow[circuit.Column], circuit, cfg.decimalSeparator)
+	if err != nil {
+		return 0, warningParse, fmt.Errorf("could not parse %s value for entity '%s': %w", circuit.Parser, key, err)
+	}
+	if value == 0 && circuit.ZeroIsMissing {
+		return 0, "", errMissing
+	}
+
+	// Certain circuits require a multiplier.
+	if key == "main" || key == "ecocute" {
+		value *= 10
+	}
+
+	if circuit.Divisor != nil {
+		value /= *circuit.Divisor
+	}
+	value *= circuit.unitScale()
+
+	// Hex values are two's complement and thus signed, while a negative
+	// decimal or float value on other circuits is usually a sensor glitch.
+	if value < 0 && circuit.Parser != parserHex && !circuit.Signed {
+		switch cfg.negativePolicy {
+		case negativeZero:
+			value = 0
+		case negativeDrop:
+			return 0, warningNegative, fmt.Errorf("dropping negative value %g of unsigned entity '%s'", value, key)
+		}
+	}
+	return value, "", nil
+}
+
+// errMissing is returned by readCircuit for a circuit without a sensor. It is
+// not a problem and such circuits are silently skipped.
+var errMissing = errors.New("no sensor connected")
+
+// circuitValue is the scaled value of a mapped or virtual circuit. Counter
+// values are in Watt-hours and duration values in seconds.
+type circuitValue struct {
+	key         string
+	value       float64
+	circuitType string
+}
+
+// fetchCircuitValues fetches the data once and reads all circuits, for the
+// push outputs. Circuits that cannot be read are logged and left out.
+func fetchCircuitValues(source *fetcher, cfg *config) ([]circuitValue, error) {
+	records, err := source.fetchRecords(cfg)
+	if err != nil {
+		return nil, err
+	}
+	_, dataRow, _, err := findDataRow(cfg, records)
+	if err != nil {
+		return nil, err
+	}
+
+	var circuits []circuitValue
+	values := make(map[string]float64, len(cfg.powerMappings))
+	for key, circuit := range cfg.powerMappings {
+		value, _, err := readCircuit(cfg, dataRow, key, circuit)
+		if errors.Is(err, errMissing) {
+			continue
+		}
+		if err != nil {
+			log.Printf("Warning: %v", err)
+			continue
+		}
+		if circuit.Type == typeGauge {
+			values[key] = value
+		}
+		circuits = append(circuits, circuitValue{key: key, value: value, circuitType: circuit.Type})
+	}
+	for key, components := range cfg.virtualCircuits {
+		if sum, ok := virtualValue(components, values); ok {
+			circuits = append(circuits, circuitValue{key: key, value: sum, circuitType: typeGauge})
+		}
+	}
+	return circuits, nil
+}
+
+// virtualValue computes the weighted sum of a virtual circuit's components.
+// It reports false if any component is missing from values.
+func virtualValue(components, values map[string]float64) (float64, bool) {
+	var sum float64
+	for component, weight := range components {
+		value, ok := values[component]
+		if !ok {
+			return 0, false
+		}
+		sum += weight * value
+	}
+	return sum, true
+}
+
+// decodeValue converts a raw CSV field into a value according to the circuit's
+// parser. decimalSeparator is the separator used by the float parser; the
+// decimal parser only accepts integers.
+func decodeValue(field string, cc circuitConfig, decimalSeparator string) (float64, error) {
+	if cc.Parser == parserHex || cc.Parser == parserScaled {
+		field, _ = normalizeHex(field)
+	}
+	if cc.TrailingSign {
+		field = leadingSign(field)
+	}
+	if cc.Separators != "" {
+		field = strings.Map(func(r rune) rune {
+			if strings.ContainsRune(cc.Separators, r) {
+				return -1
+			}
+			return r
+		}, field)
+	}
+	switch cc.Parser {
+	case parserBCD:
+		value, err := decodeBCD(field)
+		return float64(value), err
+	case parserDecimal:
+		value, err := strconv.ParseInt(field, 10, 64)
+		return float64(value), err
+	case parserFloat:
+		return strconv.ParseFloat(normalizeDecimal(field, decimalSeparator), 64)
+	case parserScaled:
+		return decodeScaled(field, cc.Mantissa, cc.Exponent)
+	default:
+		// The breaker box outputs 16-bit two's complement hex values, while
+		// some CT modules use other widths. We parse as unsigned and shift the
+		// sign bit of the configured width into place to sign-extend it.
+		uintVal, err := strconv.ParseUint(field, 16, cc.Bits)
+		if err != nil {
+			return 0, err
+		}
+		shift := 64 - cc.Bits
+		return float64(int64(uintVal<<shift) >> shift), nil
+	}
+}
+
+// normalizeHex trims the whitespace some firmware pads hex fields with, e.g.
+// " 0a2F ". It also reports whether the field needed normalization, i.e. was
+// padded or mixed upper and lower case digits, which strconv accepts as is.
+func normalizeHex(field string) (string, bool) {
+	trimmed := strings.TrimSpace(field)
+	mixedCase := strings.ContainsAny(trimmed, "abcdef") && strings.ContainsAny(trimmed, "ABCDEF")
+	return trimmed, trimmed != field || mixedCase
+}
+
+// normalizeDecimal replaces a localized decimal separator, such as the comma
+// in "230,5", with the period strconv expects.
+func normalizeDecimal(field, decimalSeparator string) string {
+	if decimalSeparator == "." {
+		return field
+	}
+	return strings.Replace(field, decimalSeparator, ".", 1)
+}
+
+// leadingSign moves a trailing sign to the front, e.g. "123-" becomes "-123",
+// so strconv can parse it. Fields without a trailing sign are returned as is.
+func leadingSign(field string) string {
+	if n := len(field); n > 1 && (field[n-1] == '-' || field[n-1] == '+') {
+		return field[n-1:] + field[:n-1]
+	}
+	return field
+}
+
+// decodeScaled interprets a hex field as a mantissa and a decimal exponent
+// stored in separate bit fields, e.g. a high nibble exponent and a 12-bit
+// mantissa, and returns mantissa × 10^exponent. The mantissa is unsigned
+// while the exponent is two's complement, so scales below one can be encoded.
+func decodeScaled(field string, mantissa, exponent bitField) (float64, error) {
+	raw, err := strconv.ParseUint(field, 16, 64)
+	if err != nil {
+		return 0, err
+	}
+	exp := int64(exponent.extract(raw))
+	if exp >= 1<<(exponent.Width-1) {
+		exp -= 1 << exponent.Width
+	}
+	return float64(mantissa.extract(raw)) * math.Pow10(int(exp)), nil
+}
+
+// decodeBCD interprets a hex field as binary-coded decimal, where every nibble
+// is one decimal digit, e.g. "1234" (0x1234) means 1234 rather than 4660.
+func decodeBCD(field string) (int64, error) {
+	if field == "" {
+		return 0, fmt.Errorf("empty BCD field")
+	}
+	for i, r := range field {
+		if r < '0' || r > '9' {
+			return 0, fmt.Errorf("invalid BCD nibble %q at position %d in %q", r, i, field)
+		}
+	}
+	return strconv.ParseInt(field, 10, 64)
+}
@@ -0,0 +1,110 @@
+package main
+
+import "testing"
+
+func TestDecodeBCD(t *testing.T) {
+	tests := []struct {
+		field   string
+		want    int64
+		wantErr bool
+	}{
+		{field: "1234", want: 1234},
+		{field: "0000", want: 0},
+		{field: "0042", want: 42},
+		{field: "12A4", wantErr: true},
+		{field: "-123", wantErr: true},
+		{field: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := decodeBCD(tt.field)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("decodeBCD(%q) error = %v, want error %t", tt.field, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("decodeBCD(%q) = %d, want %d", tt.field, got, tt.want)
+		}
+	}
+}
+
+func TestDecodeScaled(t *testing.T) {
+	// A high nibble exponent and a 12-bit mantissa.
+	mantissa := bitField{Offset: 0, Width: 12}
+	exponent := bitField{Offset: 12, Width: 4}
+	tests := []struct {
+		field   string
+		want    float64
+		wantErr bool
+	}{
+		{field: "0123", want: 0x123},
+		{field: "2123", want: 0x123 * 100},
+		{field: "F123", want: 0x123 / 10.0},
+		{field: "E064", want: 1},
+		{field: "xyz", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := decodeScaled(tt.field, mantissa, exponent)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("decodeScaled(%q) error = %v, want error %t", tt.field, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("decodeScaled(%q) = %g, want %g", tt.field, got, tt.want)
+		}
+	}
+}
+
+func TestLeadingSign(t *testing.T) {
+	tests := []struct {
+		field, want string
+	}{
+		{"123-", "-123"},
+		{"123+", "+123"},
+		{"-123", "-123"},
+		{"123", "123"},
+		{"-", "-"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := leadingSign(tt.field); got != tt.want {
+			t.Errorf("leadingSign(%q) = %q, want %q", tt.field, got, tt.want)
+		}
+	}
+}
+
+func TestDecodeValue(t *testing.T) {
+	tests := []struct {
+		name             string
+		field            string
+		cc               circuitConfig
+		decimalSeparator string
+		want             float64
+		wantErr          bool
+	}{
+		{name: "hex", field: "03E8", cc: circuitConfig{Parser: parserHex, Bits: 16}, want: 1000},
+		{name: "hex negative", field: "FFFF", cc: circuitConfig{Parser: parserHex, Bits: 16}, want: -1},
+		{name: "hex padded", field: " 0a2F ", cc: circuitConfig{Parser: parserHex, Bits: 16}, want: 0x0a2f},
+		{name: "hex separators", field: "03-E8", cc: circuitConfig{Parser: parserHex, Bits: 16, Separators: "-"}, want: 1000},
+		{name: "bcd separators", field: "12:34", cc: circuitConfig{Parser: parserBCD, Separators: ":"}, want: 1234},
+		{name: "bcd space separators", field: "12 34", cc: circuitConfig{Parser: parserBCD, Separators: " "}, want: 1234},
+		{name: "decimal", field: "-230", cc: circuitConfig{Parser: parserDecimal}, decimalSeparator: ".", want: -230},
+		{name: "decimal trailing sign", field: "230-", cc: circuitConfig{Parser: parserDecimal, TrailingSign: true}, decimalSeparator: ".", want: -230},
+		{name: "decimal without trailing sign", field: "230-", cc: circuitConfig{Parser: parserDecimal}, decimalSeparator: ".", wantErr: true},
+		{name: "decimal fraction", field: "230,5", cc: circuitConfig{Parser: parserDecimal}, decimalSeparator: ",", wantErr: true},
+		{name: "float", field: "230.5", cc: circuitConfig{Parser: parserFloat}, decimalSeparator: ".", want: 230.5},
+		{name: "float comma", field: "230,5", cc: circuitConfig{Parser: parserFloat}, decimalSeparator: ",", want: 230.5},
+		{name: "float comma trailing sign", field: "230,5-", cc: circuitConfig{Parser: parserFloat, TrailingSign: true}, decimalSeparator: ",", want: -230.5},
+		{name: "float comma with period separator", field: "230,5", cc: circuitConfig{Parser: parserFloat}, decimalSeparator: ".", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decodeValue(tt.field, tt.cc, tt.decimalSeparator)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("decodeValue(%q) error = %v, want error %t", tt.field, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("decodeValue(%q) = %g, want %g", tt.field, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+// derivedCircuit describes how a derived circuit computes its apparent and
+// reactive power. The RMS voltage and current are read from their own
+// columns, in Volts and Amperes unless a unit is given, and are not exposed
+// themselves. The real power is taken from the mapped circuit Power.
+type derivedCircuit struct {
+	Voltage circuitConfig `json:"voltage"`
+	Current circuitConfig `json:"current"`
+	Power   string        `json:"power"`
+}
+
+// validate checks the derived circuit's inputs and fills in their defaults.
+// The real power must be a mapped gauge circuit.
+func (d *derivedCircuit) validate(mappings map[string]circuitConfig) error {
+	for _, input := range []struct {
+		name     string
+		circuit  *circuitConfig
+		quantity string
+	}{
+		{"voltage", &d.Voltage, quantityVoltage},
+		{"current", &d.Current, quantityCurrent},
+	} {
+		if input.circuit.Template != "" {
+			return fmt.Errorf("%s must not use a template", input.name)
+		}
+		if input.circuit.Type != "" && input.circuit.Type != typeGauge {
+			return fmt.Errorf("%s must be a %q, got %q", input.name, typeGauge, input.circuit.Type)
+		}
+		input.circuit.quantity = input.quantity
+		if err := input.circuit.validate(); err != nil {
+			return fmt.Errorf("invalid %s: %w", input.name, err)
+		}
+	}
+	if d.Power == "" {
+		return fmt.Errorf("power circuit is not set")
+	}
+	circuit, ok := mappings[d.Power]
+	if !ok {
+		return fmt.Errorf("power references unknown circuit '%s'", d.Power)
+	}
+	if circuit.Type != typeGauge {
+		return fmt.Errorf("power references %s circuit '%s'", circuit.Type, d.Power)
+	}
+	return nil
+}
+
+// readInputs reads the voltage and current of the derived circuit key from
+// the data row. On failure, it also returns the parse warning type
+// describing the problem, like readCircuit.
+func (d derivedCircuit) readInputs(cfg *config, dataRow []string, key string) (voltage, current float64, warning string, err error) {
+	if voltage, warning, err = readCircuit(cfg, dataRow, key+".voltage", d.Voltage); err != nil {
+		return 0, 0, warning, err
+	}
+	if current, warning, err = readCircuit(cfg, dataRow, key+".current", d.Current); err != nil {
+		return 0, 0, warning, err
+	}
+	return voltage, current, "", nil
+}
+
+// powers computes the apparent power S = V·I and the reactive power
+// Q = √(S²−P²). Since the inputs are measured separately, the real power can
+// slightly exceed the apparent power, in which case the reactive power is
+// zero rather than NaN.
+func powers(voltage, current, power float64) (apparent, reactive float64) {
+	apparent = math.Abs(voltage * current)
+	return apparent, math.Sqrt(max(apparent*apparent-power*power, 0))
+}
+
+// totalPowerFactor computes the power factor of the whole panel as the sum of
+// the derived circuits' real power over the sum of their apparent power,
+// given the apparent power computed for each. It reports false if any
+// derived circuit could not be computed or there is no load. Since the
+// inputs are measured separately, the ratio can fall slightly outside
+// [-1, 1], in which case it is clamped and clamped is true.
+func totalPowerFactor(derivedCircuits map[string]derivedCircuit, apparentPowers, values map[string]float64) (factor float64, clamped, ok bool) {
+	var power, apparent float64
+	for key, derived := range derivedCircuits {
+		s, ok := apparentPowers[key]
+		if !ok {
+			return 0, false, false
+		}
+		power += values[derived.Power]
+		apparent += s
+	}
+	if apparent == 0 {
+		return 0, false, false
+	}
+	factor = power / apparent
+	if factor < -1 || factor > 1 {
+		return max(min(factor, 1), -1), true, true
+	}
+	return factor, false, true
+}
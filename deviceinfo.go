@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxFirmwareResponseSize bounds how much of the firmware endpoint's response is read.
+const maxFirmwareResponseSize = 1024
+
+// firmwareTimeout bounds the firmware request if PANASONIC_TIMEOUT is not set,
+// so a hanging endpoint cannot stall the scrapes.
+const firmwareTimeout = 10 * time.Second
+
+// firmwareField locates the firmware string within the CSV records. It is
+// either a fixed position, or the field following a record's label.
+type firmwareField struct {
+	row, column int
+	label       string
+}
+
+// parseFirmwareField parses PANASONIC_FIRMWARE_FIELD, which is either
+// "<row>:<column>" with zero-based indices, or the label in the first field
+// of the record holding the firmware string in its second field.
+func parseFirmwareField(value string) (*firmwareField, error) {
+	if value == "" {
+		return nil, nil
+	}
+	if row, column, ok := strings.Cut(value, ":"); ok {
+		r, rowErr := strconv.Atoi(row)
+		c, columnErr := strconv.Atoi(column)
+		if rowErr != nil || columnErr != nil || r < 0 || c < 0 {
+			return nil, fmt.Errorf("PANASONIC_FIRMWARE_FIELD %q is not in the form row:column", value)
+		}
+		return &firmwareField{row: r, column: c}, nil
+	}
+	return &firmwareField{label: value}, nil
+}
+
+// extract returns the firmware string from the records.
+func (f *firmwareField) extract(records [][]string) (string, error) {
+	if f.label != "" {
+		for _, record := range records {
+			if len(record) > 1 && record[0] == f.label {
+				return strings.TrimSpace(record[1]), nil
+			}
+		}
+		return "", fmt.Errorf("no record labelled %q found", f.label)
+	}
+	if f.row >= len(records) || f.column >= len(records[f.row]) {
+		return "", fmt.Errorf("firmware field %d:%d is out of bounds", f.row, f.column)
+	}
+	return strings.TrimSpace(records[f.row][f.column]), nil
+}
+
+// fetchFirmware reads the firmware string from a separate info endpoint,
+// which is expected to return it as plain text. It is requested with the same
+// client and timeout as the data, as it is fetched during the scrape.
+func fetchFirmware(cfg *config) (string, error) {
+	timeout := cfg.timeout
+	if timeout == 0 {
+		timeout = firmwareTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, cfg.firmwareURL, nil)
+	if err != nil {
+		return "", fmt.Errorf("could not create request: %w", err)
+	}
+	resp, err := cfg.httpClient().Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("received non-200 status code: %s", resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxFirmwareResponseSize))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(body)), nil
+}
+
+// deviceFirmware returns the firmware string using the configured method,
+// or an empty string if none is configured. Invalid UTF-8 is replaced, as
+// label values must be valid UTF-8.
+func deviceFirmware(cfg *config, records [][]string) (string, error) {
+	var firmware string
+	var err error
+	switch {
+	case cfg.firmwareURL != "":
+		firmware, err = fetchFirmware(cfg)
+	case cfg.firmwareField != nil:
+		firmware, err = cfg.firmwareField.extract(records)
+	}
+	return strings.ToValidUTF8(firmware, "\uFFFD"), err
+}
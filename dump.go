@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// dumpResponse writes the raw response body of the last fetch to
+// PANASONIC_DEBUG_DUMP_FILE in debug mode, after every scrape or only after
+// failed ones. Nothing is written if no body was read.
+func dumpResponse(cfg *config, body []byte, failed bool) {
+	if !cfg.debug || cfg.debugDumpFile == "" || body == nil {
+		return
+	}
+	if cfg.dumpOnFailure && !failed {
+		return
+	}
+	if err := writeDump(cfg.debugDumpFile, cfg.debugDumpKeep, body); err != nil {
+		log.Printf("Warning: could not write debug dump: %v", err)
+	}
+}
+
+// writeDump atomically replaces the dump at path with data. Up to keep dumps
+// are retained, the older ones being renamed to path.1, path.2 and so on. The
+// current dump is copied rather than renamed to path.1, so path never goes
+// missing while the dumps are rotated.
+func writeDump(path string, keep int, data []byte) error {
+	tmp, err := writeTemp(path, data)
+	if err != nil {
+		return err
+	}
+	// Missing older dumps are expected until keep dumps have been written.
+	for i := keep - 1; i > 1; i-- {
+		if err := os.Rename(dumpName(path, i-1), dumpName(path, i)); err != nil && !os.IsNotExist(err) {
+			log.Printf("Warning: could not rotate debug dump: %v", err)
+		}
+	}
+	if keep > 1 {
+		if err := copyDump(path, dumpName(path, 1)); err != nil && !os.IsNotExist(err) {
+			log.Printf("Warning: could not rotate debug dump: %v", err)
+		}
+	}
+	return os.Rename(tmp, path)
+}
+
+// copyDump atomically copies the dump at src to dst.
+func copyDump(src, dst string) error {
+	data, err := os.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(dst, data)
+}
+
+// writeFileAtomic replaces the file at path with data, so readers never see
+// a partially written file.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := writeTemp(path, data)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// writeTemp writes data to a new temporary file next to path and returns its name.
+func writeTemp(path string, data []byte) (string, error) {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return "", err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	return tmp.Name(), nil
+}
+
+// dumpName returns the file name of the i-th most recent dump.
+func dumpName(path string, i int) string {
+	if i == 0 {
+		return path
+	}
+	return fmt.Sprintf("%s.%d", path, i)
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteDumpRotates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dump.csv")
+	for _, data := range []string{"a", "b", "c", "d"} {
+		if err := writeDump(path, 3, []byte(data)); err != nil {
+			t.Fatalf("writeDump(%q) error = %v", data, err)
+		}
+	}
+	for i, want := range []string{"d", "c", "b"} {
+		got, err := os.ReadFile(dumpName(path, i))
+		if err != nil {
+			t.Fatalf("could not read dump %d: %v", i, err)
+		}
+		if string(got) != want {
+			t.Errorf("dump %d = %q, want %q", i, got, want)
+		}
+	}
+	if _, err := os.Stat(dumpName(path, 3)); !os.IsNotExist(err) {
+		t.Errorf("dump 3 exists, want only 3 dumps retained")
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// energyWindow is a window over which the consumed energy is exposed. The
+// label is the window as configured, e.g. "15m", used as the window label.
+type energyWindow struct {
+	label  string
+	length time.Duration
+}
+
+// collectEnergyWindows emits the energy consumed by a counter circuit over
+// each configured window, as the difference between the current sample and
+// the newest one at least the window's length older. The history is cleared
+// on a counter reset, so no value is emitted for a window spanning a reset,
+// nor for one longer than the history kept so far.
+func (c *panasonicCollector) collectEnergyWindows(ch chan<- prometheus.Metric, cfg *config, key string, sample counterSample, reset bool) {
+	if len(cfg.energyWindows) == 0 {
+		delete(c.counterHistory, key)
+		return
+	}
+
+	history := c.counterHistory[key]
+	if reset {
+		history = nil
+	}
+	// Cached data was served again if the sample is not newer.
+	if len(history) == 0 || sample.at.After(history[len(history)-1].at) {
+		history = append(history, sample)
+	}
+
+	var longest time.Duration
+	for _, window := range cfg.energyWindows {
+		longest = max(longest, window.length)
+		if start := windowStart(history, sample.at.Add(-window.length)); start >= 0 {
+			ch <- prometheus.MustNewConstMetric(c.energyWindowDesc, prometheus.GaugeValue, sample.value-history[start].value, key, window.label)
+		}
+	}
+
+	// Only the samples needed for the longest window are kept.
+	if start := windowStart(history, sample.at.Add(-longest)); start > 0 {
+		history = append(history[:0], history[start:]...)
+	}
+	c.counterHistory[key] = history
+}
+
+// windowStart returns the index of the newest sample taken no later than
+// start, or -1 if the history does not reach back that far.
+func windowStart(history []counterSample, start time.Time) int {
+	for i := len(history) - 1; i >= 0; i-- {
+		if !history[i].at.After(start) {
+			return i
+		}
+	}
+	return -1
+}
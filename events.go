@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+// scrapeEvent summarizes a scrape for the /events endpoint. Appeared and
+// Disappeared list the circuits reported or no longer reported compared to
+// the previous successful scrape.
+type scrapeEvent struct {
+	Time        time.Time `json:"time"`
+	Success     bool      `json:"success"`
+	Error       string    `json:"error,omitempty"`
+	Circuits    int       `json:"circuits"`
+	Appeared    []string  `json:"appeared,omitempty"`
+	Disappeared []string  `json:"disappeared,omitempty"`
+}
+
+// eventLog is a ring buffer of the most recent scrape events. It is safe for
+// concurrent use, as it is read by the /events handler during scrapes.
+type eventLog struct {
+	mu     sync.Mutex
+	events []scrapeEvent
+	// reported holds the circuits of the previous successful scrape.
+	reported map[string]bool
+}
+
+// record adds an event, dropping the oldest ones beyond size. The circuits
+// are only compared to the previous scrape's if the scrape succeeded.
+func (l *eventLog) record(event scrapeEvent, circuits []string, size int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if event.Success {
+		event.Circuits = len(circuits)
+		reported := make(map[string]bool, len(circuits))
+		for _, key := range circuits {
+			reported[key] = true
+			if l.reported != nil && !l.reported[key] {
+				event.Appeared = append(event.Appeared, key)
+			}
+		}
+		for key := range l.reported {
+			if !reported[key] {
+				event.Disappeared = append(event.Disappeared, key)
+			}
+		}
+		slices.Sort(event.Appeared)
+		slices.Sort(event.Disappeared)
+		l.reported = reported
+	}
+
+	l.events = append(l.events, event)
+	if len(l.events) > size {
+		l.events = slices.Delete(l.events, 0, len(l.events)-size)
+	}
+}
+
+// snapshot returns a copy of the events, oldest first.
+func (l *eventLog) snapshot() []scrapeEvent {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return slices.Clone(l.events)
+}
+
+// recordEvent adds the outcome of a scrape to the event log, taking the
+// error from the last error report.
+func (c *panasonicCollector) recordEvent(cfg *config, now time.Time, failed bool, circuits []string) {
+	if cfg.eventsSize == 0 {
+		return
+	}
+	event := scrapeEvent{Time: now, Success: !failed}
+	if report := c.lastError.Load(); failed && report != nil {
+		event.Error = report.Message
+	}
+	c.events.record(event, circuits, cfg.eventsSize)
+}
+
+// serveEvents serves the recent scrape events as JSON in debug mode.
+func (c *panasonicCollector) serveEvents(w http.ResponseWriter, r *http.Request) {
+	if !currentConfig().debug {
+		http.NotFound(w, r)
+		return
+	}
+	events := c.events.snapshot()
+	if events == nil {
+		events = []scrapeEvent{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(events)
+}
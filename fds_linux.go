@@ -0,0 +1,12 @@
+package main
+
+import "os"
+
+// openFDs returns the number of file descriptors open in this process.
+func openFDs() (int, error) {
+	entries, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		return 0, err
+	}
+	return len(entries), nil
+}
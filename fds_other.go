@@ -0,0 +1,10 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+// openFDs is only implemented on Linux.
+func openFDs() (int, error) {
+	return 0, errors.New("counting open file descriptors is not supported on this platform")
+}
@@ -0,0 +1,457 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"time"
+)
+
+// Supported kinds of jitter applied to the retry backoff.
+const (
+	retryJitterNone         = "none"
+	retryJitterFull         = "full"
+	retryJitterDecorrelated = "decorrelated"
+)
+
+// maxRetryBackoff caps the doubled retry backoff, so a large number of retries
+// neither waits for hours nor overflows the delay.
+const maxRetryBackoff = time.Minute
+
+// stdinURL is the PANASONIC_URL value that selects standard input as the data source.
+const stdinURL = "-"
+
+// stdinData holds the CSV data read from standard input at startup.
+var stdinData []byte
+
+// readStdin is set by the -stdin flag. It overrides PANASONIC_URL with
+// stdinURL, also on reloads, which rewrite the variables from the .env file.
+var readStdin bool
+
+// errRedirect is returned when the breaker box redirects and
+// PANASONIC_FOLLOW_REDIRECTS is disabled.
+var errRedirect = errors.New("redirects are not followed")
+
+// errDecompress is returned when a compressed response cannot be
+// decompressed, e.g. because a proxy truncated it.
+var errDecompress = errors.New("could not decompress response")
+
+// errTruncated is returned when fewer bytes than the advertised
+// Content-Length were received, e.g. because the connection dropped.
+var errTruncated = errors.New("response is truncated")
+
+// errEmptyResponse is returned when the response body is empty or only
+// whitespace, which usually means the device is down rather than that its
+// data is malformed.
+var errEmptyResponse = errors.New("response is empty, the device may be down")
+
+// noRedirectClient treats redirects, such as to the login page of a captive
+// portal, as failed requests instead of parsing the target page.
+var noRedirectClient = &http.Client{
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return fmt.Errorf("%w, got redirected to %s", errRedirect, req.URL)
+	},
+}
+
+// httpClient returns the client used to fetch from the breaker box.
+func (cfg *config) httpClient() *http.Client {
+	if !cfg.followRedirects {
+		return noRedirectClient
+	}
+	return http.DefaultClient
+}
+
+// fetcher downloads the CSV data from the breaker box. It remembers the last
+// successful response so unchanged data does not have to be downloaded again.
+// A fetcher must not be used concurrently.
+type fetcher struct {
+	// cachedURL, cachedRecords, cachedBody and lastModified describe the last successful
+	// response. lastModified is the raw Last-Modified header of that response.
+	cachedURL     string
+	cachedRecords [][]string
+	cachedBody    []byte
+	lastModified  string
+
+	// lastBody is the raw response body returned by the last call to
+	// fetchRecords, kept for debug dumps. It is nil if none was read.
+	lastBody []byte
+
+	// tlsVersion and tlsCipher describe the TLS connection of the last call
+	// to fetchRecords. They are empty if it did not use HTTPS.
+	tlsVersion string
+	tlsCipher  string
+
+	// latency is how long the breaker box took to respond to the last call
+	// to fetchRecords, including retries and reading the body. It is zero if
+	// no request was answered.
+	latency time.Duration
+
+	// readThroughput is the rate in bytes per second at which the body was
+	// read by the last call to fetchRecords. It is zero if none was downloaded.
+	readThroughput float64
+
+	// span is the trace span of the next call to fetchRecords, or nil if
+	// the scrape is not traced. Reading the body is recorded as its child.
+	span *traceSpan
+
+	// replayIndex is the index of the next file replayed from
+	// PANASONIC_REPLAY_DIR when advancing on every scrape.
+	replayIndex int
+
+	// skippedRecords is the number of malformed records skipped while
+	// parsing the response of the last call to fetchRecords.
+	skippedRecords int
+
+	// cachedAt is when the cached response was downloaded or last confirmed
+	// unchanged by the breaker box, and fromCache reports whether the last
+	// call to fetchRecords served the cached response.
+	cachedAt  time.Time
+	fromCache bool
+}
+
+// cacheAge returns how old the data returned by the last call to
+// fetchRecords is. It is zero if the data was just downloaded, and close to
+// zero if the breaker box just confirmed it unchanged.
+func (f *fetcher) cacheAge(now time.Time) time.Duration {
+	if !f.fromCache {
+		return 0
+	}
+	return now.Sub(f.cachedAt)
+}
+
+// fetchRecords downloads the CSV file from the breaker box and parses it into records.
+func (f *fetcher) fetchRecords(cfg *config) ([][]string, error) {
+	f.fromCache = false
+	f.lastBody = nil
+	f.skippedRecords = 0
+	f.tlsVersion, f.tlsCipher = "", ""
+	f.readThroughput = 0
+	f.latency = 0
+
+	// Devices that only refresh their data every few minutes would return
+	// the same data again, so it is not fetched before the interval elapsed.
+	if cfg.minRefreshInterval > 0 && f.cachedURL == cfg.breakerBoxURL && time.Since(f.cachedAt) < cfg.minRefreshInterval {
+		f.fromCache = true
+		f.lastBody = f.cachedBody
+		return f.cachedRecords, nil
+	}
+
+	// Spread the load of many exporters scraping on the same schedule.
+	time.Sleep(jitterDelay(cfg.fetchJitter))
+
+	if cfg.replayDir != "" {
+		body, err := f.replayBody(cfg)
+		if err != nil {
+			return nil, err
+		}
+		return f.parseBody(cfg, body)
+	}
+	if cfg.breakerBoxURL == stdinURL {
+		if stdinData == nil {
+			return nil, errors.New("standard input can only be used as the data source at startup")
+		}
+		return f.parseBody(cfg, stdinData)
+	}
+
+	// No new fetches are started during shutdown.
+	if draining.Load() {
+		if f.cachedRecords == nil {
+			return nil, errDraining
+		}
+		f.fromCache = true
+		f.lastBody = f.cachedBody
+		return f.cachedRecords, nil
+	}
+
+	// The overall timeout covers all attempts including retries and backoff,
+	// as well as reading the response body.
+	ctx := context.Background()
+	if cfg.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cfg.timeout)
+		defer cancel()
+	}
+
+	// Only a cached response with a Last-Modified header can be revalidated.
+	cached := cfg.preflightHead && f.cachedURL == cfg.breakerBoxURL && f.lastModified != ""
+
+	// Devices that are slow to generate the CSV are first asked whether it
+	// changed at all, which also checks their reachability cheaply.
+	if cached {
+		req, err := http.NewRequestWithContext(ctx, http.MethodHead, cfg.breakerBoxURL, nil)
+		if err != nil {
+			return nil, fmt.Errorf("could not create request: %w", err)
+		}
+		resp, err := cfg.httpClient().Do(req)
+		if err != nil {
+			return nil, fmt.Errorf("could not send pre-flight HEAD request to breaker box: %w", err)
+		}
+		resp.Body.Close()
+		f.recordTLS(resp)
+		if resp.StatusCode == http.StatusOK && resp.Header.Get("Last-Modified") == f.lastModified {
+			f.cachedAt = time.Now()
+			f.fromCache = true
+			f.lastBody = f.cachedBody
+			return f.cachedRecords, nil
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, cfg.breakerBoxURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not create request: %w", err)
+	}
+	if cached {
+		req.Header.Set("If-Modified-Since", f.lastModified)
+	}
+
+	requestStart := time.Now()
+	resp, err := doWithRetries(cfg, req)
+	if err != nil {
+		return nil, fmt.Errorf("could not fetch data from breaker box: %w", err)
+	}
+	defer resp.Body.Close()
+	f.recordTLS(resp)
+	f.span.set("http.response.status_code", resp.StatusCode)
+
+	if cached && resp.StatusCode == http.StatusNotModified {
+		f.latency = time.Since(requestStart)
+		f.cachedAt = time.Now()
+		f.fromCache = true
+		f.lastBody = f.cachedBody
+		return f.cachedRecords, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("received non-200 status code: %s", resp.Status)
+	}
+
+	readStart := time.Now()
+	readSpan := f.span.child("read_body", otlpSpanInternal)
+	body, err := readBody(resp)
+	readSpan.set("body.bytes", len(body))
+	readSpan.end(err)
+	if err != nil {
+		return nil, err
+	}
+	f.latency = time.Since(requestStart)
+	if elapsed := time.Since(readStart).Seconds(); elapsed > 0 {
+		f.readThroughput = float64(len(body)) / elapsed
+	}
+	// A body the device compressed on its own is only decompressed once it
+	// was read completely, so the time spent on each can be told apart. The
+	// transport leaves it alone, as it did not ask for compression.
+	if resp.Header.Get("Content-Encoding") == "gzip" {
+		decompressSpan := f.span.child("decompress", otlpSpanInternal)
+		decompressSpan.set("body.compressed_bytes", len(body))
+		body, err = gunzip(body)
+		decompressSpan.set("body.bytes", len(body))
+		decompressSpan.end(err)
+		if err != nil {
+			return nil, err
+		}
+	}
+	records, err := f.parseBody(cfg, body)
+	if err != nil {
+		return nil, err
+	}
+	f.cachedURL = cfg.breakerBoxURL
+	f.cachedRecords = records
+	f.cachedBody = body
+	f.lastModified = resp.Header.Get("Last-Modified")
+	f.cachedAt = time.Now()
+	return records, nil
+}
+
+// recordTLS remembers the TLS version and cipher suite of the response's
+// connection, if it used TLS.
+func (f *fetcher) recordTLS(resp *http.Response) {
+	if resp.TLS != nil {
+		f.tlsVersion = tls.VersionName(resp.TLS.Version)
+		f.tlsCipher = tls.CipherSuiteName(resp.TLS.CipherSuite)
+	}
+}
+
+// doWithRetries sends the request, retrying on transport errors and on the
+// configured status codes with exponential backoff. The response of the last
+// attempt is returned, even if its status code would have been retried.
+// Retrying stops once the request's context is done.
+func doWithRetries(cfg *config, req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	var delay time.Duration
+	for attempt := 0; ; attempt++ {
+		resp, err := doAttempt(cfg, req)
+		// A redirect will not go away by retrying.
+		if attempt >= cfg.retries || ctx.Err() != nil || errors.Is(err, errRedirect) {
+			return resp, err
+		}
+		if err == nil {
+			if !cfg.retryStatus(resp.StatusCode) {
+				return resp, nil
+			}
+			resp.Body.Close()
+			log.Printf("Warning: received status %s, retrying (attempt %d of %d).", resp.Status, attempt+1, cfg.retries)
+		} else {
+			log.Printf("Warning: %v, retrying (attempt %d of %d).", err, attempt+1, cfg.retries)
+		}
+		delay = retryDelay(cfg, attempt, delay)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// retryDelay returns the delay before the retry following the given attempt.
+// Without jitter, the backoff doubles on every retry. Full jitter picks a
+// random delay up to that, while decorrelated jitter picks one between the
+// base backoff and three times the previous delay, capped at the longest
+// doubled backoff. Both keep exporters from retrying in lockstep.
+func retryDelay(cfg *config, attempt int, previous time.Duration) time.Duration {
+	switch cfg.retryJitter {
+	case retryJitterFull:
+		return jitterDelay(doubledBackoff(cfg.retryBackoff, attempt))
+	case retryJitterDecorrelated:
+		upper := max(previous*3, cfg.retryBackoff)
+		return min(cfg.retryBackoff+jitterDelay(upper-cfg.retryBackoff), doubledBackoff(cfg.retryBackoff, cfg.retries))
+	}
+	return doubledBackoff(cfg.retryBackoff, attempt)
+}
+
+// doubledBackoff doubles backoff once per attempt, stopping at maxRetryBackoff.
+// A configured backoff above the cap is used as is.
+func doubledBackoff(backoff time.Duration, attempt int) time.Duration {
+	for ; attempt > 0 && backoff < maxRetryBackoff; attempt-- {
+		backoff = min(backoff*2, maxRetryBackoff)
+	}
+	return backoff
+}
+
+// doAttempt sends a single attempt of the request, bounded by the per-attempt
+// timeout so one slow attempt does not use up the budget of the retries. The
+// timeout keeps applying while the response body is read.
+func doAttempt(cfg *config, req *http.Request) (*http.Response, error) {
+	if cfg.attemptTimeout == 0 {
+		return cfg.httpClient().Do(req)
+	}
+	ctx, cancel := context.WithTimeout(req.Context(), cfg.attemptTimeout)
+	resp, err := cfg.httpClient().Do(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+// cancelOnClose releases a request's context once its response body is closed.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+// Close closes the body and cancels the context.
+func (c *cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
+
+// readBody reads the whole response body. It is read completely before
+// parsing, so a truncated body is reported as such instead of as malformed
+// CSV and no partial data is used. A body the device compressed on its own
+// is returned as read.
+func readBody(resp *http.Response) ([]byte, error) {
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		// The transport decompresses gzip transparently if it asked for
+		// it, in which case reading fails on a corrupt body.
+		if resp.Uncompressed {
+			return nil, fmt.Errorf("%w: %v", errDecompress, err)
+		}
+		// The transport reports a body shorter than its Content-Length as
+		// an unexpected EOF.
+		if errors.Is(err, io.ErrUnexpectedEOF) && resp.ContentLength >= 0 {
+			return nil, fmt.Errorf("%w: read %d of %d bytes", errTruncated, len(data), resp.ContentLength)
+		}
+		return nil, fmt.Errorf("could not read response: %w", err)
+	}
+	if !resp.Uncompressed && resp.ContentLength >= 0 && int64(len(data)) != resp.ContentLength {
+		return nil, fmt.Errorf("%w: read %d of %d bytes", errTruncated, len(data), resp.ContentLength)
+	}
+	return data, nil
+}
+
+// gunzip decompresses a gzip compressed body.
+func gunzip(data []byte) ([]byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errDecompress, err)
+	}
+	defer zr.Close()
+	decompressed, err := io.ReadAll(zr)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errDecompress, err)
+	}
+	return decompressed, nil
+}
+
+// parseBody parses a response body into records, remembering it for debug
+// dumps and counting the skipped records.
+func (f *fetcher) parseBody(cfg *config, body []byte) ([][]string, error) {
+	f.lastBody = body
+	if isBlank(body) {
+		return nil, errEmptyResponse
+	}
+	records, skipped, err := parseRecords(bytes.NewReader(body), cfg.skipBadRecords)
+	f.skippedRecords = skipped
+	return records, err
+}
+
+// isBlank reports whether a response body holds nothing but whitespace.
+func isBlank(body []byte) bool {
+	return len(bytes.TrimSpace(body)) == 0
+}
+
+// parseRecords parses CSV data into records. With skipBad, records with
+// malformed quotes are skipped instead of failing the whole parse, and the
+// number of skipped records is returned.
+func parseRecords(r io.Reader, skipBad bool) ([][]string, int, error) {
+	// The CSV parser is configured to be flexible, as device-generated files
+	// can have an inconsistent number of columns per row.
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1 // Allow variable number of fields per record
+
+	var records [][]string
+	var skipped int
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return records, skipped, nil
+		}
+		if err != nil {
+			if skipBad && (errors.Is(err, csv.ErrQuote) || errors.Is(err, csv.ErrBareQuote)) {
+				log.Printf("Warning: skipping malformed CSV record: %v", err)
+				skipped++
+				continue
+			}
+			return nil, skipped, fmt.Errorf("could not parse CSV data: %w", err)
+		}
+		records = append(records, record)
+	}
+}
+
+// jitterDelay returns a random delay in the range [0, max].
+func jitterDelay(max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+	return rand.N(max + 1)
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// truncatedReader returns its data followed by an unexpected EOF, like the
+// transport does for a body shorter than its Content-Length.
+type truncatedReader struct {
+	r io.Reader
+}
+
+func (t *truncatedReader) Read(p []byte) (int, error) {
+	n, err := t.r.Read(p)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func gzipped(t *testing.T, data string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write([]byte(data)); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestReadBody(t *testing.T) {
+	const body = "1,2,3\n"
+	tests := []struct {
+		name          string
+		body          io.Reader
+		contentLength int64
+		uncompressed  bool
+		want          string
+		wantErr       error
+	}{
+		{name: "complete", body: strings.NewReader(body), contentLength: int64(len(body)), want: body},
+		{name: "unknown length", body: strings.NewReader(body), contentLength: -1, want: body},
+		{name: "short body", body: strings.NewReader(body), contentLength: 100, wantErr: errTruncated},
+		{name: "unexpected EOF", body: &truncatedReader{strings.NewReader(body)}, contentLength: 100, wantErr: errTruncated},
+		{name: "transparent gzip", body: strings.NewReader(body), contentLength: -1, uncompressed: true, want: body},
+		{name: "corrupt transparent gzip", body: &truncatedReader{strings.NewReader(body)}, contentLength: -1, uncompressed: true, wantErr: errDecompress},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := &http.Response{
+				Body:          io.NopCloser(tt.body),
+				ContentLength: tt.contentLength,
+				Uncompressed:  tt.uncompressed,
+			}
+			got, err := readBody(resp)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("readBody() error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("readBody() error = %v", err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("readBody() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGunzip(t *testing.T) {
+	const body = "1,2,3\n"
+	compressed := gzipped(t, body)
+	tests := []struct {
+		name    string
+		data    []byte
+		want    string
+		wantErr bool
+	}{
+		{name: "valid", data: compressed, want: body},
+		{name: "truncated", data: compressed[:len(compressed)-4], wantErr: true},
+		{name: "not gzip", data: []byte(body), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := gunzip(tt.data)
+			if tt.wantErr {
+				if !errors.Is(err, errDecompress) {
+					t.Fatalf("gunzip() error = %v, want %v", err, errDecompress)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("gunzip() error = %v", err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("gunzip() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDoubledBackoff(t *testing.T) {
+	tests := []struct {
+		backoff time.Duration
+		attempt int
+		want    time.Duration
+	}{
+		{backoff: 500 * time.Millisecond, attempt: 0, want: 500 * time.Millisecond},
+		{backoff: 500 * time.Millisecond, attempt: 3, want: 4 * time.Second},
+		{backoff: 500 * time.Millisecond, attempt: 100, want: maxRetryBackoff},
+		{backoff: time.Hour, attempt: 2, want: time.Hour},
+	}
+	for _, tt := range tests {
+		if got := doubledBackoff(tt.backoff, tt.attempt); got != tt.want {
+			t.Errorf("doubledBackoff(%v, %d) = %v, want %v", tt.backoff, tt.attempt, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"time"
+)
+
+// Supported protocols of the Graphite/StatsD push output.
+const (
+	pushProtocolGraphite = "graphite"
+	pushProtocolStatsD   = "statsd"
+)
+
+// graphiteDialTimeout bounds how long a push waits for the connection.
+const graphiteDialTimeout = 5 * time.Second
+
+// graphiteNameReplacer replaces characters that have a special meaning in
+// Graphite and StatsD metric paths.
+var graphiteNameReplacer = strings.NewReplacer(".", "_", " ", "_", ":", "_", "|", "_")
+
+// runGraphitePusher periodically fetches the data and pushes each circuit's
+// value to the configured Graphite or StatsD address. It runs forever and
+// picks up configuration changes on every iteration, doing nothing while no
+// address is configured.
+func runGraphitePusher() {
+	var source fetcher
+	for {
+		cfg := currentConfig()
+		time.Sleep(cfg.graphiteInterval)
+
+		cfg = currentConfig()
+		if cfg.graphiteAddress == "" {
+			continue
+		}
+		if err := pushGraphite(&source, cfg, time.Now()); err != nil {
+			log.Printf("Error: Could not push metrics to %s: %v", cfg.graphiteAddress, err)
+		}
+	}
+}
+
+// pushGraphite reads all circuits once and sends them in a single push.
+func pushGraphite(source *fetcher, cfg *config, now time.Time) error {
+	circuits, err := fetchCircuitValues(source, cfg)
+	if err != nil {
+		return err
+	}
+
+	var lines []string
+	for _, circuit := range circuits {
+		metric, value := "power_watts", circuit.value
+		switch circuit.circuitType {
+		case typeCounter:
+			metric = "energy_" + cfg.energyUnit
+			if cfg.energyUnit == energyUnitKilowattHours {
+				value /= 1000
+			}
+		case typeDuration:
+			metric = "runtime_seconds"
+		}
+		lines = append(lines, graphiteLine(cfg, metric, circuit.key, value, now))
+	}
+	return sendGraphite(cfg, lines)
+}
+
+// graphiteLine formats a single value in the configured protocol.
+func graphiteLine(cfg *config, metric, key string, value float64, now time.Time) string {
+	path := fmt.Sprintf("%s.%s.%s", cfg.graphitePrefix, metric, graphiteNameReplacer.Replace(key))
+	if cfg.graphiteProtocol == pushProtocolStatsD {
+		// StatsD treats a signed gauge value as a relative change, so a
+		// negative value has to be set by resetting the gauge to zero first.
+		if value < 0 {
+			return fmt.Sprintf("%s:0|g\n%s:%g|g\n", path, path, value)
+		}
+		return fmt.Sprintf("%s:%g|g\n", path, value)
+	}
+	return fmt.Sprintf("%s %g %d\n", path, value, now.Unix())
+}
+
+// sendGraphite writes the lines to the configured address. Graphite's
+// plaintext protocol uses TCP and receives all lines at once, while StatsD
+// uses UDP with one datagram per circuit so no packet grows beyond the MTU.
+func sendGraphite(cfg *config, lines []string) error {
+	network := "tcp"
+	if cfg.graphiteProtocol == pushProtocolStatsD {
+		network = "udp"
+	}
+	conn, err := net.DialTimeout(network, cfg.graphiteAddress, graphiteDialTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetWriteDeadline(time.Now().Add(graphiteDialTimeout))
+
+	if network == "tcp" {
+		var buf bytes.Buffer
+		for _, line := range lines {
+			buf.WriteString(line)
+		}
+		_, err = conn.Write(buf.Bytes())
+		return err
+	}
+	for _, line := range lines {
+		if _, err := conn.Write([]byte(line)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
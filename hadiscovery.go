@@ -0,0 +1,86 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"net/http"
+	"slices"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// haSensor is a Home Assistant sensor configuration in the format of MQTT
+// discovery payloads, describing a single circuit.
+type haSensor struct {
+	Name        string `json:"name"`
+	UniqueID    string `json:"unique_id"`
+	Unit        string `json:"unit_of_measurement"`
+	DeviceClass string `json:"device_class,omitempty"`
+	StateClass  string `json:"state_class"`
+	// Metric and Entity identify the series the sensor's value is exposed in.
+	Metric string `json:"metric"`
+	Entity string `json:"entity"`
+}
+
+// haSensors describes the mapped and virtual circuits as Home Assistant
+// sensors, sorted by entity.
+func haSensors(cfg *config) []haSensor {
+	sensors := make([]haSensor, 0, len(cfg.powerMappings)+len(cfg.virtualCircuits))
+	for key, circuit := range cfg.powerMappings {
+		sensor := haSensor{
+			Name:     cfg.friendlyName(key),
+			UniqueID: namespace + "_" + key,
+			Entity:   key,
+		}
+		switch circuit.Type {
+		case typeCounter:
+			// Energy is exposed in the unit collectEnergy uses.
+			sensor.Unit = "Wh"
+			sensor.DeviceClass = "energy"
+			sensor.StateClass = "total_increasing"
+			sensor.Metric = prometheus.BuildFQName(namespace, "energy", "watt_hours_total")
+			if cfg.energyUnit == energyUnitKilowattHours {
+				sensor.Unit = "kWh"
+				sensor.Metric = prometheus.BuildFQName(namespace, "energy", "kilowatt_hours_total")
+			}
+		case typeDuration:
+			sensor.Unit = "s"
+			sensor.DeviceClass = "duration"
+			sensor.StateClass = "total_increasing"
+			sensor.Metric = prometheus.BuildFQName(namespace, "", "runtime_seconds")
+		default:
+			sensor.Unit = "W"
+			sensor.DeviceClass = "power"
+			sensor.StateClass = "measurement"
+			sensor.Metric = prometheus.BuildFQName(namespace, "power", "watts")
+		}
+		sensors = append(sensors, sensor)
+	}
+	for key := range cfg.virtualCircuits {
+		sensors = append(sensors, haSensor{
+			Name:        cfg.friendlyName(key),
+			UniqueID:    namespace + "_" + key,
+			Unit:        "W",
+			DeviceClass: "power",
+			StateClass:  "measurement",
+			Metric:      prometheus.BuildFQName(namespace, "power", "watts"),
+			Entity:      key,
+		})
+	}
+	slices.SortFunc(sensors, func(a, b haSensor) int {
+		return cmp.Compare(a.Entity, b.Entity)
+	})
+	return sensors
+}
+
+// serveHADiscovery serves the Home Assistant sensor configurations of all
+// circuits as JSON if enabled, for importing them in one step.
+func serveHADiscovery(w http.ResponseWriter, r *http.Request) {
+	cfg := currentConfig()
+	if !cfg.haDiscovery {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(haSensors(cfg))
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// errorReport describes the most recent scrape error for the /lasterror
+// endpoint. Once a scrape succeeds, the error is cleared and only the time it
+// was cleared is kept.
+type errorReport struct {
+	Time      *time.Time `json:"time,omitempty"`
+	Category  string     `json:"category,omitempty"`
+	Message   string     `json:"message,omitempty"`
+	ClearedAt *time.Time `json:"cleared_at,omitempty"`
+}
+
+// errorCategory classifies a scrape error, falling back to def.
+func errorCategory(err error, def string) string {
+	switch {
+	case errors.Is(err, errDecompress):
+		return "decompress"
+	case errors.Is(err, errTruncated):
+		return "truncated"
+	case errors.Is(err, errEmptyResponse):
+		return "empty_response"
+	case errors.Is(err, errRedirect):
+		return "redirect"
+	case errors.Is(err, errDuplicateKey):
+		return "duplicate_key"
+	}
+	return def
+}
+
+// recordError remembers a failed scrape for the /lasterror endpoint.
+func (c *panasonicCollector) recordError(err error, category string, now time.Time) {
+	report := errorReport{Time: &now, Category: errorCategory(err, category), Message: err.Error()}
+	if last := c.lastError.Load(); last != nil {
+		report.ClearedAt = last.ClearedAt
+	}
+	c.lastError.Store(&report)
+}
+
+// clearError clears the last error after a successful scrape.
+func (c *panasonicCollector) clearError(now time.Time) {
+	if last := c.lastError.Load(); last != nil && last.Time != nil {
+		c.lastError.Store(&errorReport{ClearedAt: &now})
+	}
+}
+
+// serveLastError serves the last scrape error as JSON in debug mode.
+func (c *panasonicCollector) serveLastError(w http.ResponseWriter, r *http.Request) {
+	if !currentConfig().debug {
+		http.NotFound(w, r)
+		return
+	}
+	report := c.lastError.Load()
+	if report == nil {
+		report = &errorReport{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
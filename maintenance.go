@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+)
+
+// maintenanceOverride is the maintenance state set through the /maintenance
+// endpoint. It is nil until set, in which case PANASONIC_MAINTENANCE applies.
+var maintenanceOverride atomic.Pointer[bool]
+
+// inMaintenance reports whether the device is in planned maintenance.
+func inMaintenance(cfg *config) bool {
+	if override := maintenanceOverride.Load(); override != nil {
+		return *override
+	}
+	return cfg.maintenance
+}
+
+// serveMaintenance turns maintenance mode on or off in debug mode, e.g. with
+// POST /maintenance?enabled=true. The state is kept until the exporter
+// restarts, even across reloads.
+func serveMaintenance(w http.ResponseWriter, r *http.Request) {
+	if !currentConfig().debug {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Only POST requests allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+	enabled, err := strconv.ParseBool(r.FormValue("enabled"))
+	if err != nil {
+		http.Error(w, "The enabled parameter must be true or false.", http.StatusBadRequest)
+		return
+	}
+	maintenanceOverride.Store(&enabled)
+	log.Printf("Maintenance mode set to %t.", enabled)
+	fmt.Fprintf(w, "Maintenance mode set to %t.\n", enabled)
+}
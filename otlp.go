@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// otlpTimeout bounds a single push to the OTLP endpoint.
+const otlpTimeout = 10 * time.Second
+
+// otlpClient sends the OTLP pushes.
+var otlpClient = &http.Client{Timeout: otlpTimeout}
+
+// The types below model the subset of the OTLP/HTTP JSON encoding of
+// ExportMetricsServiceRequest needed for gauges and cumulative sums.
+type (
+	otlpRequest struct {
+		ResourceMetrics []otlpResourceMetrics `json:"resourceMetrics"`
+	}
+	otlpResourceMetrics struct {
+		Resource     otlpResource       `json:"resource"`
+		ScopeMetrics []otlpScopeMetrics `json:"scopeMetrics"`
+	}
+	otlpResource struct {
+		Attributes []otlpAttribute `json:"attributes"`
+	}
+	otlpScopeMetrics struct {
+		Scope   otlpScope    `json:"scope"`
+		Metrics []otlpMetric `json:"metrics"`
+	}
+	otlpScope struct {
+		Name string `json:"name"`
+	}
+	otlpMetric struct {
+		Name  string     `json:"name"`
+		Unit  string     `json:"unit"`
+		Gauge *otlpGauge `json:"gauge,omitempty"`
+		Sum   *otlpSum   `json:"sum,omitempty"`
+	}
+	otlpGauge struct {
+		DataPoints []otlpDataPoint `json:"dataPoints"`
+	}
+	otlpSum struct {
+		DataPoints             []otlpDataPoint `json:"dataPoints"`
+		AggregationTemporality int             `json:"aggregationTemporality"`
+		IsMonotonic            bool            `json:"isMonotonic"`
+	}
+	otlpDataPoint struct {
+		Attributes   []otlpAttribute `json:"attributes"`
+		TimeUnixNano string          `json:"timeUnixNano"`
+		AsDouble     float64         `json:"asDouble"`
+	}
+	otlpAttribute struct {
+		Key   string         `json:"key"`
+		Value otlpAttrString `json:"value"`
+	}
+	otlpAttrString struct {
+		StringValue string `json:"stringValue"`
+	}
+)
+
+// otlpCumulative is AGGREGATION_TEMPORALITY_CUMULATIVE.
+const otlpCumulative = 2
+
+// runOTLPPusher periodically fetches the data and pushes each circuit's value
+// to the configured OTLP endpoint. Like runGraphitePusher, it runs forever and
+// does nothing while no endpoint is configured.
+func runOTLPPusher() {
+	var source fetcher
+	for {
+		cfg := currentConfig()
+		time.Sleep(cfg.otlpInterval)
+
+		cfg = currentConfig()
+		if cfg.otlpEndpoint == "" {
+			continue
+		}
+		if err := pushOTLP(&source, cfg, time.Now()); err != nil {
+			log.Printf("Error: Could not push metrics to %s: %v", cfg.otlpEndpoint, err)
+		}
+	}
+}
+
+// pushOTLP reads all circuits once and sends them in a single request. Power
+// and runtime are sent as gauges and energy as a cumulative monotonic sum,
+// with the Prometheus labels as attributes and the namespace as
+// instrumentation scope.
+func pushOTLP(source *fetcher, cfg *config, now time.Time) error {
+	circuits, err := fetchCircuitValues(source, cfg)
+	if err != nil {
+		return err
+	}
+
+	timestamp := strconv.FormatInt(now.UnixNano(), 10)
+	power := otlpMetric{Name: namespace + ".power", Unit: "W", Gauge: &otlpGauge{}}
+	energy := otlpMetric{Name: namespace + ".energy", Unit: "Wh", Sum: &otlpSum{AggregationTemporality: otlpCumulative, IsMonotonic: true}}
+	runtime := otlpMetric{Name: namespace + ".runtime", Unit: "s", Gauge: &otlpGauge{}}
+	for _, circuit := range circuits {
+		point := otlpDataPoint{
+			Attributes: []otlpAttribute{
+				{Key: "entity", Value: otlpAttrString{circuit.key}},
+				{Key: "friendly_name", Value: otlpAttrString{cfg.friendlyName(circuit.key)}},
+			},
+			TimeUnixNano: timestamp,
+			AsDouble:     circuit.value,
+		}
+		switch circuit.circuitType {
+		case typeCounter:
+			energy.Sum.DataPoints = append(energy.Sum.DataPoints, point)
+		case typeDuration:
+			runtime.Gauge.DataPoints = append(runtime.Gauge.DataPoints, point)
+		default:
+			power.Gauge.DataPoints = append(power.Gauge.DataPoints, point)
+		}
+	}
+
+	var metrics []otlpMetric
+	if len(power.Gauge.DataPoints) > 0 {
+		metrics = append(metrics, power)
+	}
+	if len(energy.Sum.DataPoints) > 0 {
+		metrics = append(metrics, energy)
+	}
+	if len(runtime.Gauge.DataPoints) > 0 {
+		metrics = append(metrics, runtime)
+	}
+	body, err := json.Marshal(otlpRequest{ResourceMetrics: []otlpResourceMetrics{{
+		Resource: otlpResource{Attributes: []otlpAttribute{
+			{Key: "service.name", Value: otlpAttrString{"panasonic-exporter"}},
+		}},
+		ScopeMetrics: []otlpScopeMetrics{{Scope: otlpScope{Name: namespace}, Metrics: metrics}},
+	}}})
+	if err != nil {
+		return err
+	}
+
+	resp, err := otlpClient.Post(cfg.otlpEndpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("received non-2xx status code: %s", resp.Status)
+	}
+	return nil
+}
@@ -2,164 +2,1083 @@
 package main
 
 import (
-	"encoding/csv"
-	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
 	"log"
+	"maps"
+	"math"
 	"net/http"
 	"os"
+	"runtime"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
+	"unicode"
 
-	"github.com/joho/godotenv"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/common/expfmt"
 )
 
-// Configuration is loaded from environment variables.
-var (
-	breakerBoxURL string
-	powerMappings map[string]int
-)
+// staleNaN is the bit pattern Prometheus uses internally to mark a series as stale
+// (see value.StaleNaN in the Prometheus server). The client library does not export it.
+var staleNaN = math.Float64frombits(0x7ff0000000000002)
 
 const (
 	listenAddress = ":9190"
+	metricsPath   = "/metrics"
 	namespace     = "panasonic"
+
+	// Types of the panasonic_parse_warnings_total counter.
+	warningOutOfBounds   = "out_of_bounds"
+	warningParse         = "parse"
+	warningEmptyField    = "empty_field"
+	warningWidthMismatch = "width_mismatch"
+	warningNegative      = "negative"
 )
 
+// circuitChange records the last value of a circuit and when it changed.
+type circuitChange struct {
+	value     float64
+	changedAt time.Time
+}
+
+// counterSample records a counter value, when it was fetched, and the power
+// derived from the increase since the previous sample, if known.
+type counterSample struct {
+	value   float64
+	at      time.Time
+	rate    float64
+	hasRate bool
+}
+
 // panasonicCollector manages all logic for fetching data and creating metrics.
 type panasonicCollector struct {
-	powerDesc *prometheus.Desc
-	mutex     sync.Mutex
+	powerDesc         *prometheus.Desc
+	energyDesc        *prometheus.Desc
+	energyKWhDesc     *prometheus.Desc
+	readingTimeDesc   *prometheus.Desc
+	configMtimeDesc   *prometheus.Desc
+	openFDsDesc       *prometheus.Desc
+	goroutinesDesc    *prometheus.Desc
+	thresholdDesc     *prometheus.Desc
+	deviceInfoDesc    *prometheus.Desc
+	cacheAgeDesc      *prometheus.Desc
+	columnsDesc       *prometheus.Desc
+	intervalDesc      *prometheus.Desc
+	lastChangeDesc    *prometheus.Desc
+	ewmaDesc          *prometheus.Desc
+	readingDateDesc   *prometheus.Desc
+	clockDriftDesc    *prometheus.Desc
+	energyRateDesc    *prometheus.Desc
+	inRangeDesc       *prometheus.Desc
+	runtimeDesc       *prometheus.Desc
+	cfgWarningsDesc   *prometheus.Desc
+	apparentDesc      *prometheus.Desc
+	reactiveDesc      *prometheus.Desc
+	powerFactorDesc   *prometheus.Desc
+	energyWindowDesc  *prometheus.Desc
+	lockWaitDesc      *prometheus.Desc
+	staleDesc         *prometheus.Desc
+	tlsInfoDesc       *prometheus.Desc
+	configHashDesc    *prometheus.Desc
+	parseDurationDesc *prometheus.Desc
+	parserInfoDesc    *prometheus.Desc
+	throughputDesc    *prometheus.Desc
+	maintenanceDesc   *prometheus.Desc
+	latencyP95Desc    *prometheus.Desc
+	mutex             sync.Mutex
+
+	// source fetches the data. It is guarded by mutex.
+	source fetcher
+
+	// powerSummary records every scraped power value. It is only collected when
+	// the power family is listed in PANASONIC_SUMMARY_FAMILIES, and is rebuilt
+	// whenever a reload changes the objectives.
+	powerSummary      *prometheus.SummaryVec
+	summaryObjectives map[float64]float64
+
+	// parseWarnings counts recoverable problems found while parsing the data row.
+	parseWarnings *prometheus.CounterVec
+
+	// counterResets counts decreases of counter circuits, and lastCounters
+	// holds the previous sample of each counter circuit to detect them and
+	// to derive the power.
+	counterResets *prometheus.CounterVec
+	lastCounters  map[string]counterSample
+
+	// counterHistory holds the recent samples of each counter circuit for
+	// the energy consumed over the configured windows.
+	counterHistory map[string][]counterSample
+
+	// lastChanges holds the last value of each circuit and when it changed,
+	// to find idle circuits.
+	lastChanges map[string]circuitChange
+
+	// ewma holds the exponentially smoothed power of each circuit.
+	ewma map[string]float64
+
+	// lastEmitted holds the last power value emitted for each circuit, for
+	// hysteresis.
+	lastEmitted map[string]float64
+
+	// decompressErrors counts scrapes failed by a compressed response that
+	// could not be decompressed.
+	decompressErrors prometheus.Counter
+
+	// truncatedResponses counts scrapes failed by a response shorter than
+	// its Content-Length.
+	truncatedResponses prometheus.Counter
+
+	// skippedRecords counts malformed CSV records skipped with
+	// PANASONIC_SKIP_BAD_RECORDS.
+	skippedRecords prometheus.Counter
+
+	// untimestampedRows counts data rows without a parseable timestamp that
+	// were left out of time-based row selection.
+	untimestampedRows prometheus.Counter
+
+	// powerFactorAnomalies counts total power factors outside [-1, 1] that
+	// were clamped.
+	powerFactorAnomalies prometheus.Counter
+
+	// hexNormalized counts hex fields that were padded with whitespace or
+	// mixed upper and lower case, which hints at sloppy firmware.
+	hexNormalized prometheus.Counter
+
+	// droppedSeries counts series dropped by the PANASONIC_MAX_SERIES limit.
+	droppedSeries prometheus.Counter
+
+	// duplicateKeyErrors counts scrapes failed by duplicate rows in key-column selection.
+	duplicateKeyErrors prometheus.Counter
+
+	// consecutiveSuccesses counts successful scrapes since the last failure.
+	// It is read by the /ready handler without taking the collector mutex.
+	consecutiveSuccesses atomic.Int64
+
+	// lastError describes the most recent scrape error. It is read by the
+	// /lasterror handler without taking the collector mutex.
+	lastError atomic.Pointer[errorReport]
+
+	// latencies holds the response latencies in seconds of the recent
+	// fetches, oldest first.
+	latencies []float64
+
+	// events holds the most recent scrape events for the /events endpoint.
+	events eventLog
 }
 
 // newPanasonicCollector initializes the collector.
 func newPanasonicCollector() *panasonicCollector {
-	return &panasonicCollector{
+	c := &panasonicCollector{
 		powerDesc: prometheus.NewDesc(
 			prometheus.BuildFQName(namespace, "power", "watts"),
 			"Current power consumption in Watts.",
 			[]string{"entity", "friendly_name"},
 			nil,
 		),
+		energyDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "energy", "watt_hours_total"),
+			"Cumulative energy consumption in Watt-hours.",
+			[]string{"entity", "friendly_name"},
+			nil,
+		),
+		energyKWhDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "energy", "kilowatt_hours_total"),
+			"Cumulative energy consumption in kilowatt-hours.",
+			[]string{"entity", "friendly_name"},
+			nil,
+		),
+		readingTimeDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "reading_timestamp_seconds"),
+			"Timestamp reported by the device for the data row, in Unix seconds.",
+			nil,
+			nil,
+		),
+		configMtimeDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "config_file", "mtime_seconds"),
+			"Modification time of the loaded configuration file, in Unix seconds.",
+			nil,
+			nil,
+		),
+		openFDsDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "open_fds"),
+			"Number of open file descriptors of the exporter.",
+			nil,
+			nil,
+		),
+		goroutinesDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "goroutines"),
+			"Number of goroutines of the exporter.",
+			nil,
+			nil,
+		),
+		thresholdDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "power", "threshold_watts"),
+			"Configured alerting threshold of each circuit's power consumption in Watts.",
+			[]string{"entity", "level"},
+			nil,
+		),
+		deviceInfoDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "device", "info"),
+			"Information about the breaker box. The value is always 1.",
+			[]string{"firmware"},
+			nil,
+		),
+		cacheAgeDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "cache", "age_seconds"),
+			"Age of the served data in seconds. Zero when the data was just fetched from the device.",
+			nil,
+			nil,
+		),
+		columnsDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "datarow", "columns"),
+			"Number of fields in the selected data row. A change signals a layout shift that may invalidate the column mappings.",
+			nil,
+			nil,
+		),
+		intervalDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "scrape_interval_hint_seconds"),
+			"Scrape interval in seconds assumed by windowed computations. It should match the scrape_interval of Prometheus.",
+			nil,
+			nil,
+		),
+		lastChangeDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "circuit", "last_change_seconds"),
+			"Unix timestamp of when each circuit's value last changed, or was first read by the exporter.",
+			[]string{"entity"},
+			nil,
+		),
+		ewmaDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "power", "watts_ewma"),
+			"Exponentially weighted moving average of each circuit's power consumption in Watts.",
+			[]string{"entity", "friendly_name"},
+			nil,
+		),
+		readingDateDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "reading", "date"),
+			"Calendar date of the reading timestamp. The value is always 1.",
+			[]string{"year", "month", "day"},
+			nil,
+		),
+		clockDriftDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "clock", "drift_seconds"),
+			"Reading timestamp of the device minus the exporter's clock at fetch time in seconds. Positive when the device clock is ahead.",
+			nil,
+			nil,
+		),
+		energyRateDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "energy", "rate_watts"),
+			"Power in Watts derived from the increase of each counter circuit between scrapes.",
+			[]string{"entity", "friendly_name"},
+			nil,
+		),
+		inRangeDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "circuit", "in_range"),
+			"Whether each circuit's value lies within its configured plausible range (1) or not (0).",
+			[]string{"entity"},
+			nil,
+		),
+		runtimeDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "runtime_seconds"),
+			"Runtime reported by each duration circuit in seconds, e.g. of a compressor.",
+			[]string{"entity", "friendly_name"},
+			nil,
+		),
+		cfgWarningsDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "config_warnings"),
+			"Number of likely mistakes found in the circuit mappings when the configuration was loaded.",
+			nil,
+			nil,
+		),
+		apparentDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "apparent_power_voltamperes"),
+			"Apparent power in Volt-amperes of each derived circuit, computed from its voltage and current.",
+			[]string{"entity", "friendly_name"},
+			nil,
+		),
+		reactiveDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "reactive_power_voltamperes_reactive"),
+			"Reactive power in Volt-amperes reactive of each derived circuit, computed from its apparent and real power.",
+			[]string{"entity", "friendly_name"},
+			nil,
+		),
+		powerFactorDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "total_power_factor"),
+			"Power factor of the whole panel, the summed real power of the derived circuits over their summed apparent power.",
+			nil,
+			nil,
+		),
+		energyWindowDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "energy", "interval_watt_hours"),
+			"Energy in Watt-hours consumed by each counter circuit over each configured window.",
+			[]string{"entity", "window"},
+			nil,
+		),
+		lockWaitDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "collect", "lock_wait_seconds"),
+			"Time in seconds this scrape waited for earlier scrapes to finish.",
+			nil,
+			nil,
+		),
+		staleDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "circuit", "stale"),
+			"Whether each circuit's value stayed unchanged for longer than its configured max_age (1) or not (0).",
+			[]string{"entity"},
+			nil,
+		),
+		tlsInfoDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "device", "tls_info"),
+			"Always 1, labelled with the TLS version and cipher suite negotiated with the breaker box over HTTPS.",
+			[]string{"version", "cipher"},
+			nil,
+		),
+		configHashDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "config", "hash_info"),
+			"Always 1, labelled with a hash of the configuration variables to spot differently configured exporters.",
+			[]string{"hash"},
+			nil,
+		),
+		parseDurationDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "family", "parse_duration_seconds"),
+			"Time in seconds spent decoding the circuits of each metric family in the last scrape.",
+			[]string{"family"},
+			nil,
+		),
+		parserInfoDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "circuit", "parser_info"),
+			"Always 1, labelled with the parser and type each circuit's value is decoded with.",
+			[]string{"entity", "parser", "type"},
+			nil,
+		),
+		throughputDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "body_read_bytes_per_second"),
+			"Rate in bytes per second at which the response body was read from the breaker box.",
+			nil,
+			nil,
+		),
+		maintenanceDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "maintenance"),
+			"Whether the device is in planned maintenance (1) or not (0), so alerts can be suppressed.",
+			nil,
+			nil,
+		),
+		latencyP95Desc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "fetch", "latency_p95_seconds"),
+			"95th percentile in seconds of the breaker box response latency over the recent fetches.",
+			nil,
+			nil,
+		),
+		parseWarnings: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "parse_warnings_total",
+			Help:      "Total number of warnings raised while parsing the CSV data, by type.",
+		}, []string{"type"}),
+		counterResets: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "counter_resets_total",
+			Help:      "Total number of times a counter circuit decreased between scrapes, e.g. after a device reboot.",
+		}, []string{"entity"}),
+		lastCounters:   make(map[string]counterSample),
+		counterHistory: make(map[string][]counterSample),
+		lastChanges:    make(map[string]circuitChange),
+		ewma:           make(map[string]float64),
+		lastEmitted:    make(map[string]float64),
+		decompressErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "decompress_errors_total",
+			Help:      "Total number of scrapes failed because the compressed response could not be decompressed.",
+		}),
+		truncatedResponses: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "truncated_responses_total",
+			Help:      "Total number of scrapes failed because the response was shorter than its Content-Length.",
+		}),
+		skippedRecords: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "skipped_records_total",
+			Help:      "Total number of malformed CSV records skipped while parsing.",
+		}),
+		untimestampedRows: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "untimestamped_rows_total",
+			Help:      "Total number of data rows without a parseable timestamp left out of time-based row selection.",
+		}),
+		powerFactorAnomalies: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "total_power_factor_anomalies_total",
+			Help:      "Total number of whole-panel power factors outside [-1, 1] that were clamped.",
+		}),
+		hexNormalized: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "hex_normalized_total",
+			Help:      "Total number of hex fields that had to be trimmed of whitespace or were in mixed case.",
+		}),
+		droppedSeries: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "dropped_series_total",
+			Help:      "Total number of series dropped because a scrape exceeded the series limit.",
+		}),
+		duplicateKeyErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "duplicate_key_errors_total",
+			Help:      "Total number of scrapes failed because several data rows matched the key.",
+		}),
 	}
+	for _, warning := range []string{warningOutOfBounds, warningParse, warningEmptyField, warningWidthMismatch, warningNegative} {
+		c.parseWarnings.WithLabelValues(warning)
+	}
+	c.updateSummaries(currentConfig())
+	return c
+}
+
+// updateSummaries rebuilds the summaries if their objectives changed.
+// Rebuilding discards all observations made so far.
+func (c *panasonicCollector) updateSummaries(cfg *config) {
+	if c.powerSummary != nil && maps.Equal(c.summaryObjectives, cfg.summaryObjectives) {
+		return
+	}
+	// Only the entity label is used to keep the number of quantile series down.
+	c.powerSummary = prometheus.NewSummaryVec(prometheus.SummaryOpts{
+		Namespace:  namespace,
+		Name:       "power_watts_summary",
+		Help:       "Summary of the power consumption in Watts observed on each scrape.",
+		Objectives: cfg.summaryObjectives,
+	}, []string{"entity"})
+	c.summaryObjectives = cfg.summaryObjectives
 }
 
 // Describe implements the prometheus.Collector interface.
 func (c *panasonicCollector) Describe(ch chan<- *prometheus.Desc) {
 	ch <- c.powerDesc
+	// Both energy units are described so the unit can be changed on reload,
+	// but only the configured one is ever collected.
+	ch <- c.energyDesc
+	ch <- c.energyKWhDesc
+	ch <- c.readingTimeDesc
+	ch <- c.configMtimeDesc
+	ch <- c.openFDsDesc
+	ch <- c.goroutinesDesc
+	ch <- c.thresholdDesc
+	ch <- c.deviceInfoDesc
+	ch <- c.cacheAgeDesc
+	ch <- c.columnsDesc
+	ch <- c.intervalDesc
+	ch <- c.lastChangeDesc
+	ch <- c.ewmaDesc
+	ch <- c.readingDateDesc
+	ch <- c.clockDriftDesc
+	ch <- c.energyRateDesc
+	ch <- c.inRangeDesc
+	ch <- c.runtimeDesc
+	ch <- c.cfgWarningsDesc
+	ch <- c.apparentDesc
+	ch <- c.reactiveDesc
+	ch <- c.powerFactorDesc
+	ch <- c.energyWindowDesc
+	ch <- c.lockWaitDesc
+	ch <- c.staleDesc
+	ch <- c.tlsInfoDesc
+	ch <- c.configHashDesc
+	ch <- c.parseDurationDesc
+	ch <- c.parserInfoDesc
+	ch <- c.throughputDesc
+	ch <- c.maintenanceDesc
+	ch <- c.latencyP95Desc
+	c.powerSummary.Describe(ch)
+	c.parseWarnings.Describe(ch)
+	c.counterResets.Describe(ch)
+	c.duplicateKeyErrors.Describe(ch)
+	c.decompressErrors.Describe(ch)
+	c.truncatedResponses.Describe(ch)
+	c.skippedRecords.Describe(ch)
+	c.untimestampedRows.Describe(ch)
+	c.hexNormalized.Describe(ch)
+	c.powerFactorAnomalies.Describe(ch)
+	c.droppedSeries.Describe(ch)
 }
 
 // Collect implements the prometheus.Collector interface.
 // It is triggered by Prometheus on each scrape.
 func (c *panasonicCollector) Collect(ch chan<- prometheus.Metric) {
+	// Overlapping scrapes wait for each other, e.g. behind a slow fetch.
+	waitStart := time.Now()
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
+	ch <- prometheus.MustNewConstMetric(c.lockWaitDesc, prometheus.GaugeValue, time.Since(waitStart).Seconds())
 
-	resp, err := http.Get(breakerBoxURL)
-	if err != nil {
-		log.Printf("Error fetching data from breaker box: %v", err)
+	// Use a single configuration snapshot for the whole scrape, even if a
+	// reload happens concurrently.
+	cfg := currentConfig()
+
+	// The count of dropped series and the lock wait are exempt from the
+	// limit, so the limit itself stays visible.
+	defer c.droppedSeries.Collect(ch)
+	if cfg.maxSeries == 0 {
+		c.collect(ch, cfg)
 		return
 	}
-	defer resp.Body.Close()
+	limited := make(chan prometheus.Metric)
+	go func() {
+		c.collect(limited, cfg)
+		close(limited)
+	}()
+	var series, dropped int
+	for metric := range limited {
+		if series < cfg.maxSeries {
+			ch <- metric
+			series++
+			continue
+		}
+		dropped++
+	}
+	if dropped > 0 {
+		log.Printf("Warning: dropped %d series exceeding PANASONIC_MAX_SERIES (%d).", dropped, cfg.maxSeries)
+		c.droppedSeries.Add(float64(dropped))
+	}
+}
 
-	if resp.StatusCode != http.StatusOK {
-		log.Printf("Error: Received non-200 status code: %s", resp.Status)
-		return
+// collect emits the metrics of a scrape with the given configuration.
+func (c *panasonicCollector) collect(ch chan<- prometheus.Metric, cfg *config) {
+	c.updateSummaries(cfg)
+	if cfg.summaryFamilies[familyPower] {
+		defer c.powerSummary.Collect(ch)
 	}
+	defer c.parseWarnings.Collect(ch)
+	defer c.counterResets.Collect(ch)
+	defer c.duplicateKeyErrors.Collect(ch)
+	defer c.decompressErrors.Collect(ch)
+	defer c.truncatedResponses.Collect(ch)
+	defer c.skippedRecords.Collect(ch)
+	defer c.untimestampedRows.Collect(ch)
+	defer c.hexNormalized.Collect(ch)
+	defer c.powerFactorAnomalies.Collect(ch)
+
+	ch <- prometheus.MustNewConstMetric(c.cfgWarningsDesc, prometheus.GaugeValue, float64(len(cfg.configWarnings)))
+	ch <- prometheus.MustNewConstMetric(c.configHashDesc, prometheus.GaugeValue, 1, cfg.hash)
+	maintenance := 0.0
+	if inMaintenance(cfg) {
+		maintenance = 1
+	}
+	ch <- prometheus.MustNewConstMetric(c.maintenanceDesc, prometheus.GaugeValue, maintenance)
+	if !cfg.fileModTime.IsZero() {
+		ch <- prometheus.MustNewConstMetric(c.configMtimeDesc, prometheus.GaugeValue, float64(cfg.fileModTime.Unix()))
+	}
+
+	// Thresholds and decoding settings come from the configuration, so they
+	// are exposed even if the device cannot be reached.
+	for key, circuit := range cfg.powerMappings {
+		ch <- prometheus.MustNewConstMetric(c.parserInfoDesc, prometheus.GaugeValue, 1, key, circuit.Parser, circuit.Type)
+		if circuit.Thresholds.Warn != nil {
+			ch <- prometheus.MustNewConstMetric(c.thresholdDesc, prometheus.GaugeValue, *circuit.Thresholds.Warn, key, "warn")
+		}
+		if circuit.Thresholds.Crit != nil {
+			ch <- prometheus.MustNewConstMetric(c.thresholdDesc, prometheus.GaugeValue, *circuit.Thresholds.Crit, key, "crit")
+		}
+	}
+
+	ch <- prometheus.MustNewConstMetric(c.intervalDesc, prometheus.GaugeValue, cfg.scrapeIntervalHint.Seconds())
+
+	// Leak indicators for long-running installs, available even when the
+	// standard process and Go collectors are not.
+	ch <- prometheus.MustNewConstMetric(c.goroutinesDesc, prometheus.GaugeValue, float64(runtime.NumGoroutine()))
+	if fds, err := openFDs(); err == nil {
+		ch <- prometheus.MustNewConstMetric(c.openFDsDesc, prometheus.GaugeValue, float64(fds))
+	}
+
+	// The dump and the event are written once the outcome of the scrape is
+	// known.
+	failed := true
+	var reported []string
+	defer func() { dumpResponse(cfg, c.source.lastBody, failed) }()
+	defer func() { c.recordEvent(cfg, time.Now(), failed, reported) }()
 
-	// The CSV parser is configured to be flexible, as device-generated files
-	// can have an inconsistent number of columns per row.
-	reader := csv.NewReader(resp.Body)
-	reader.FieldsPerRecord = -1 // Allow variable number of fields per record
+	// The trace is exported once the outcome of the scrape is known too. Its
+	// spans are nil and ignored if tracing is disabled.
+	trace := startTrace(cfg, "collect")
+	defer func() {
+		var err error
+		if report := c.lastError.Load(); failed && report != nil {
+			err = errors.New(report.Message)
+		} else if failed {
+			err = errors.New("scrape failed")
+		}
+		trace.set("circuits.reported", len(reported))
+		trace.export(cfg, err)
+	}()
 
-	records, err := reader.ReadAll()
+	c.source.span = trace.child("fetch", otlpSpanClient)
+	records, err := c.source.fetchRecords(cfg)
+	c.source.span.set("cache.hit", c.source.fromCache)
+	c.source.span.set("body.bytes", len(c.source.lastBody))
+	c.source.span.end(err)
+	c.skippedRecords.Add(float64(c.source.skippedRecords))
+	c.collectLatency(ch, cfg, c.source.latency)
 	if err != nil {
-		log.Printf("Error parsing CSV data: %v", err)
+		log.Printf("Error: %v", err)
+		if errors.Is(err, errDecompress) {
+			c.decompressErrors.Inc()
+		}
+		if errors.Is(err, errTruncated) {
+			c.truncatedResponses.Inc()
+		}
+		c.recordError(err, "fetch", time.Now())
+		c.consecutiveSuccesses.Store(0)
+		c.collectFailed(ch, cfg)
 		return
 	}
 
-	var dataRow []string
-	headerIndex := -1
+	// Data served from the cache was fetched when it was downloaded.
+	now := time.Now()
+	cacheAge := c.source.cacheAge(now)
+	fetchedAt := now.Add(-cacheAge)
+	ch <- prometheus.MustNewConstMetric(c.cacheAgeDesc, prometheus.GaugeValue, cacheAge.Seconds())
 
-	// To handle malformed or partial responses, we search for the specific header
-	// row ("YYYYMMDDhhmm") and assume the data is on the next line.
-	for i, row := range records {
-		if len(row) > 0 && row[0] == "YYYYMMDDhhmm" {
-			headerIndex = i
-			break
-		}
+	// A drop in throughput points at the network rather than at a device
+	// that is slow to start responding.
+	if c.source.readThroughput > 0 {
+		ch <- prometheus.MustNewConstMetric(c.throughputDesc, prometheus.GaugeValue, c.source.readThroughput)
 	}
 
-	if headerIndex == -1 {
-		log.Printf("Error: CSV header row ('YYYYMMDDhhmm') not found in the response.")
-		return
+	// The negotiated TLS parameters are exposed for auditing weak settings.
+	if c.source.tlsVersion != "" {
+		ch <- prometheus.MustNewConstMetric(c.tlsInfoDesc, prometheus.GaugeValue, 1, c.source.tlsVersion, c.source.tlsCipher)
+	}
+
+	// The firmware can change with an update, so it is read on every scrape.
+	if firmware, err := deviceFirmware(cfg, records); err != nil {
+		log.Printf("Warning: could not read firmware version: %v", err)
+	} else if firmware != "" {
+		ch <- prometheus.MustNewConstMetric(c.deviceInfoDesc, prometheus.GaugeValue, 1, firmware)
 	}
-	if len(records) <= headerIndex+1 {
-		log.Printf("Error: Data row not found immediately after the header row.")
+
+	parseSpan := trace.child("parse", otlpSpanInternal)
+	header, dataRow, untimestamped, err := findDataRow(cfg, records)
+	c.untimestampedRows.Add(float64(untimestamped))
+	if err != nil {
+		parseSpan.end(err)
+		log.Printf("Error: %v", err)
+		if errors.Is(err, errDuplicateKey) {
+			c.duplicateKeyErrors.Inc()
+		}
+		c.recordError(err, "datarow", time.Now())
+		c.consecutiveSuccesses.Store(0)
+		c.collectFailed(ch, cfg)
 		return
 	}
+	c.consecutiveSuccesses.Add(1)
+	c.clearError(time.Now())
+	failed = false
 
-	dataRow = records[headerIndex+1]
+	ch <- prometheus.MustNewConstMetric(c.columnsDesc, prometheus.GaugeValue, float64(len(dataRow)))
+
+	// A data row that is narrower or wider than its header usually means the
+	// response was truncated or the device firmware changed its layout.
+	if len(dataRow) != len(header) {
+		log.Printf("Warning: data row has %d fields but the header row has %d.", len(dataRow), len(header))
+		c.parseWarnings.WithLabelValues(warningWidthMismatch).Inc()
+	}
+
+	// Every circuit is read from the same row, so they share its timestamp.
+	readingTime, err := parseReadingTime(dataRow)
+	if err != nil {
+		log.Printf("Warning: %v", err)
+	} else {
+		ch <- prometheus.MustNewConstMetric(c.readingTimeDesc, prometheus.GaugeValue, float64(readingTime.Unix()))
+		// The device clock only has minute resolution, so small drifts are
+		// expected even on a correct clock.
+		ch <- prometheus.MustNewConstMetric(c.clockDriftDesc, prometheus.GaugeValue, readingTime.Sub(fetchedAt).Seconds())
+		if cfg.readingDate {
+			year, month, day := readingTime.Date()
+			ch <- prometheus.MustNewConstMetric(c.readingDateDesc, prometheus.GaugeValue, 1,
+				strconv.Itoa(year), strconv.Itoa(int(month)), strconv.Itoa(day))
+		}
+	}
 
 	// Iterate through our configured circuit mappings to create metrics.
-	for key, columnIndex := range powerMappings {
-		if len(dataRow) <= columnIndex {
-			log.Printf("Warning: column index %d for entity '%s' is out of bounds.", columnIndex, key)
+	// Scaled values are kept for computing virtual circuits afterwards.
+	// The parse time is summed per family to show which one dominates on
+	// wide data rows.
+	values := make(map[string]float64, len(cfg.powerMappings))
+	parseDurations := make(map[string]time.Duration)
+	for key, circuit := range cfg.powerMappings {
+		parseStart := time.Now()
+		value, warning, err := readCircuit(cfg, dataRow, key, circuit)
+		parseDurations[circuit.family()] += time.Since(parseStart)
+		if errors.Is(err, errMissing) {
+			continue
+		}
+		if err != nil {
+			log.Printf("Warning: %v", err)
+			c.parseWarnings.WithLabelValues(warning).Inc()
+			continue
+		}
+		reported = append(reported, key)
+		if circuit.Parser == parserHex || circuit.Parser == parserScaled {
+			if _, normalized := normalizeHex(dataRow[circuit.Column]); normalized {
+				c.hexNormalized.Inc()
+			}
+		}
+
+		switch circuit.Type {
+		case typeCounter:
+			c.collectCounter(ch, cfg, key, value, fetchedAt)
+		case typeDuration:
+			ch <- prometheus.MustNewConstMetric(c.runtimeDesc, prometheus.GaugeValue, value, key, cfg.friendlyName(key))
+		default:
+			values[key] = value
+			c.collectPower(ch, cfg, key, value)
+		}
+		c.collectLastChange(ch, key, value, now)
+		if circuit.maxAge > 0 {
+			stale := 0.0
+			if now.Sub(c.lastChanges[key].changedAt) > circuit.maxAge {
+				stale = 1
+			}
+			ch <- prometheus.MustNewConstMetric(c.staleDesc, prometheus.GaugeValue, stale, key)
+		}
+		if circuit.Range.configured() {
+			inRange := 0.0
+			if circuit.Range.contains(value) {
+				inRange = 1
+			}
+			ch <- prometheus.MustNewConstMetric(c.inRangeDesc, prometheus.GaugeValue, inRange, key)
+		}
+	}
+
+	for family, duration := range parseDurations {
+		ch <- prometheus.MustNewConstMetric(c.parseDurationDesc, prometheus.GaugeValue, duration.Seconds(), family)
+	}
+	parseSpan.set("circuits.read", len(reported))
+	parseSpan.end(nil)
+
+	// Virtual circuits are weighted sums of physical ones. They are skipped
+	// if any component could not be read, as a partial sum would be misleading.
+	for key, components := range cfg.virtualCircuits {
+		sum, ok := virtualValue(components, values)
+		if !ok {
+			log.Printf("Warning: skipping virtual circuit '%s' because not all of its components could be read.", key)
 			continue
 		}
+		c.collectPower(ch, cfg, key, sum)
+		reported = append(reported, key)
+	}
 
-		// The breaker box outputs 16-bit two's complement hex values.
-		// We parse as 16-bit unsigned, then cast to int16 to get the correct negative numbers.
-		uintVal, err := strconv.ParseUint(dataRow[columnIndex], 16, 16)
+	// Derived circuits are only emitted when all of their inputs were read
+	// this scrape.
+	apparentPowers := make(map[string]float64, len(cfg.derivedCircuits))
+	for key, derived := range cfg.derivedCircuits {
+		voltage, current, warning, err := derived.readInputs(cfg, dataRow, key)
 		if err != nil {
-			log.Printf("Warning: could not parse hex value for entity '%s': %v", key, err)
+			if warning != "" {
+				c.parseWarnings.WithLabelValues(warning).Inc()
+			}
+			log.Printf("Warning: skipping derived circuit '%s': %v", key, err)
+			continue
+		}
+		power, ok := values[derived.Power]
+		if !ok {
+			log.Printf("Warning: skipping derived circuit '%s' because its power circuit '%s' could not be read.", key, derived.Power)
 			continue
 		}
-		value := int64(int16(uintVal))
+		apparent, reactive := powers(voltage, current, power)
+		apparentPowers[key] = apparent
+		ch <- prometheus.MustNewConstMetric(c.apparentDesc, prometheus.GaugeValue, apparent, key, cfg.friendlyName(key))
+		ch <- prometheus.MustNewConstMetric(c.reactiveDesc, prometheus.GaugeValue, reactive, key, cfg.friendlyName(key))
+	}
+	if cfg.totalPowerFactor {
+		if factor, clamped, ok := totalPowerFactor(cfg.derivedCircuits, apparentPowers, values); ok {
+			if clamped {
+				c.powerFactorAnomalies.Inc()
+			}
+			ch <- prometheus.MustNewConstMetric(c.powerFactorDesc, prometheus.GaugeValue, factor)
+		}
+	}
+}
+
+// collectCounter emits the energy counter of a circuit and the power derived
+// from its increase since the previous scrape. A value lower than on the
+// previous scrape is counted as a reset, which Prometheus' rate functions
+// handle as long as the series is exposed as a counter. No power is derived
+// across a reset.
+func (c *panasonicCollector) collectCounter(ch chan<- prometheus.Metric, cfg *config, key string, value float64, fetchedAt time.Time) {
+	sample := counterSample{value: value, at: fetchedAt}
+	var reset bool
+	if last, ok := c.lastCounters[key]; ok {
+		elapsed := fetchedAt.Sub(last.at).Seconds()
+		switch {
+		case value < last.value:
+			log.Printf("Warning: counter for entity '%s' decreased from %g to %g, treating it as a reset.", key, last.value, value)
+			c.counterResets.WithLabelValues(key).Inc()
+			reset = true
+		case elapsed > 0:
+			sample.rate, sample.hasRate = (value-last.value)*3600/elapsed, true
+		default:
+			// Cached data was served again, so the rate is unchanged.
+			sample = last
+		}
+	}
+	c.lastCounters[key] = sample
+	c.collectEnergy(ch, cfg, key, value)
+	if sample.hasRate {
+		ch <- prometheus.MustNewConstMetric(c.energyRateDesc, prometheus.GaugeValue, sample.rate, key, cfg.friendlyName(key))
+	}
+	c.collectEnergyWindows(ch, cfg, key, sample, reset)
+}
+
+// collectLatency records the latency of a fetch that was answered by the
+// breaker box and emits the 95th percentile over the configured window, using
+// the nearest-rank method. Fetches served without a request are not counted.
+func (c *panasonicCollector) collectLatency(ch chan<- prometheus.Metric, cfg *config, latency time.Duration) {
+	if cfg.latencyWindow == 0 {
+		c.latencies = nil
+		return
+	}
+	if latency > 0 {
+		c.latencies = append(c.latencies, latency.Seconds())
+	}
+	if len(c.latencies) > cfg.latencyWindow {
+		c.latencies = slices.Delete(c.latencies, 0, len(c.latencies)-cfg.latencyWindow)
+	}
+	if len(c.latencies) == 0 {
+		return
+	}
+	sorted := slices.Sorted(slices.Values(c.latencies))
+	rank := int(math.Ceil(0.95 * float64(len(sorted))))
+	ch <- prometheus.MustNewConstMetric(c.latencyP95Desc, prometheus.GaugeValue, sorted[rank-1])
+}
+
+// collectLastChange emits when the value of a circuit last changed. The first
+// value read counts as a change, as nothing is known about earlier ones.
+func (c *panasonicCollector) collectLastChange(ch chan<- prometheus.Metric, key string, value float64, now time.Time) {
+	last, ok := c.lastChanges[key]
+	if !ok || value != last.value {
+		last = circuitChange{value: value, changedAt: now}
+		c.lastChanges[key] = last
+	}
+	ch <- prometheus.MustNewConstMetric(c.lastChangeDesc, prometheus.GaugeValue, float64(last.changedAt.Unix()), key)
+}
+
+// collectEnergy emits an energy counter given in Watt-hours in the configured unit.
+func (c *panasonicCollector) collectEnergy(ch chan<- prometheus.Metric, cfg *config, key string, wattHours float64) {
+	value := wattHours
+	if cfg.energyUnit == energyUnitKilowattHours {
+		value /= 1000
+	}
+	ch <- prometheus.MustNewConstMetric(c.energyDescFor(cfg), prometheus.CounterValue, value, key, cfg.friendlyName(key))
+}
+
+// energyDescFor returns the descriptor of the energy counters in the
+// configured unit.
+func (c *panasonicCollector) energyDescFor(cfg *config) *prometheus.Desc {
+	if cfg.energyUnit == energyUnitKilowattHours {
+		return c.energyKWhDesc
+	}
+	return c.energyDesc
+}
+
+// collectPower emits the power metric of a circuit, applying hysteresis, and
+// records it in the summary and the moving average.
+func (c *panasonicCollector) collectPower(ch chan<- prometheus.Metric, cfg *config, key string, value float64) {
+	// With hysteresis, small fluctuations repeat the last emitted value. The
+	// summary and the moving average still see the actual value.
+	emitted := value
+	if last, ok := c.lastEmitted[key]; ok && cfg.hysteresis > 0 && math.Abs(value-last) <= cfg.hysteresis {
+		emitted = last
+	}
+	c.lastEmitted[key] = emitted
+	ch <- prometheus.MustNewConstMetric(c.powerDesc, prometheus.GaugeValue, emitted, key, cfg.friendlyName(key))
+	if cfg.summaryFamilies[familyPower] {
+		c.powerSummary.WithLabelValues(key).Observe(value)
+	}
+	if cfg.ewmaAlpha > 0 {
+		// The average starts at the first value read instead of at zero.
+		avg, ok := c.ewma[key]
+		if !ok {
+			avg = value
+		}
+		avg += cfg.ewmaAlpha * (value - avg)
+		c.ewma[key] = avg
+		ch <- prometheus.MustNewConstMetric(c.ewmaDesc, prometheus.GaugeValue, avg, key, cfg.friendlyName(key))
+	}
+}
+
+// ready reports whether enough consecutive scrapes have succeeded to consider
+// the device warmed up.
+func (c *panasonicCollector) ready() bool {
+	return c.consecutiveSuccesses.Load() >= int64(currentConfig().warmupScrapes)
+}
 
-		// Certain circuits require a multiplier.
-		if key == "main" || key == "ecocute" {
-			value *= 10
+// collectFailed is called when a scrape fails. By default it emits nothing, but
+// it can emit an explicit staleness marker or a sentinel value for every
+// configured circuit instead. Counters only get the staleness marker, as
+// Prometheus would take a sentinel for a counter reset.
+func (c *panasonicCollector) collectFailed(ch chan<- prometheus.Metric, cfg *config) {
+	var value float64
+	switch {
+	case cfg.unreachableValue != nil:
+		value = *cfg.unreachableValue
+	case cfg.staleMarkers:
+		value = staleNaN
+	default:
+		return
+	}
+	for key, circuit := range cfg.powerMappings {
+		switch circuit.Type {
+		case typeCounter:
+			// The marker is emitted unscaled, as converting it to kWh would
+			// not preserve its bit pattern.
+			if cfg.staleMarkers {
+				ch <- prometheus.MustNewConstMetric(c.energyDescFor(cfg), prometheus.CounterValue, value, key, cfg.friendlyName(key))
+			}
+			continue
+		case typeDuration:
+			ch <- prometheus.MustNewConstMetric(c.runtimeDesc, prometheus.GaugeValue, value, key, cfg.friendlyName(key))
+			continue
 		}
+		ch <- prometheus.MustNewConstMetric(c.powerDesc, prometheus.GaugeValue, value, key, cfg.friendlyName(key))
+	}
+	for key := range cfg.virtualCircuits {
+		ch <- prometheus.MustNewConstMetric(c.powerDesc, prometheus.GaugeValue, value, key, cfg.friendlyName(key))
+	}
+}
+
+// friendlyName returns the human-readable name of an entity key. Unless the
+// friendly names file names it, it is derived from the key, e.g.
+// "kitchen_appliances" becomes "KitchenAppliances". Keys starting with a
+// digit, such as bare circuit numbers, get the configured prefix, so "1"
+// becomes "Circuit1" with PANASONIC_FRIENDLY_PREFIX=Circuit.
+func (cfg *config) friendlyName(key string) string {
+	if name, ok := cfg.friendlyNames[key]; ok {
+		return name
+	}
+	name := strings.ReplaceAll(strings.Title(strings.ReplaceAll(key, "_", " ")), " ", "")
+	if name != "" && unicode.IsDigit(rune(name[0])) {
+		name = cfg.friendlyPrefix + name
+	}
+	return name
+}
 
-		friendlyName := strings.ReplaceAll(strings.Title(strings.ReplaceAll(key, "_", " ")), " ", "")
-		ch <- prometheus.MustNewConstMetric(c.powerDesc, prometheus.GaugeValue, float64(value), key, friendlyName)
+// serveLandingPage links to the metrics and notes whether access to them is
+// restricted, as following the link then fails for other clients.
+func serveLandingPage(w http.ResponseWriter, r *http.Request) {
+	note := ""
+	if len(currentConfig().allowedCIDRs) > 0 {
+		note = " (restricted to allowed networks)"
 	}
+	fmt.Fprintf(w, `
+			<html><head><title>Panasonic Exporter</title></head>
+			<body><h1>Panasonic Breaker Box Exporter</h1><p><a href="%s">Metrics</a>%s</p></body>
+			</html>
+		`, metricsPath, note)
+}
+
+// writeMetrics gathers all metrics from the gatherer and writes them to w in
+// the text exposition format.
+func writeMetrics(w io.Writer, gatherer prometheus.Gatherer) error {
+	families, err := gatherer.Gather()
+	if err != nil {
+		return err
+	}
+	encoder := expfmt.NewEncoder(w, expfmt.NewFormat(expfmt.TypeTextPlain))
+	for _, family := range families {
+		if err := encoder.Encode(family); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func main() {
+	flag.BoolVar(&readStdin, "stdin", false, "Read the CSV data from standard input instead of PANASONIC_URL.")
+	once := flag.Bool("once", false, "Print the metrics of a single scrape in the text exposition format and exit.")
+	flag.Parse()
+
 	// Load configuration from a .env file in the same directory as the executable.
-	if err := godotenv.Load(); err != nil {
+	if err := loadEnvFile(); err != nil {
 		log.Println("No .env file found, relying on existing environment variables.")
 	}
-
-	breakerBoxURL = os.Getenv("PANASONIC_URL")
-	mappingsJSON := os.Getenv("PANASONIC_MAPPINGS")
-
-	if breakerBoxURL == "" || mappingsJSON == "" {
-		log.Fatal("Error: PANASONIC_URL and PANASONIC_MAPPINGS must be set in the .env file or environment.")
+	if err := loadRemoteConfig(); err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+	cfg, err := loadConfig()
+	if err != nil {
+		log.Fatalf("Error: %v", err)
 	}
+	liveConfig.Store(cfg)
 
-	// Parse the circuit mappings from the JSON string.
-	if err := json.Unmarshal([]byte(mappingsJSON), &powerMappings); err != nil {
-		log.Fatalf("Error: Could not parse PANASONIC_MAPPINGS JSON: %v", err)
+	// Standard input can only be consumed once, so it is buffered up front
+	// and parsed again on every scrape.
+	if cfg.breakerBoxURL == stdinURL {
+		if stdinData, err = io.ReadAll(os.Stdin); err != nil {
+			log.Fatalf("Error: Could not read standard input: %v", err)
+		}
 	}
 
 	collector := newPanasonicCollector()
+
+	if *once {
+		registry := prometheus.NewRegistry()
+		registry.MustRegister(collector)
+		if err := writeMetrics(os.Stdout, registry); err != nil {
+			log.Fatalf("Error: Could not write metrics: %v", err)
+		}
+		return
+	}
+
+	if cfg := currentConfig(); cfg.stateFile != "" {
+		collector.loadState(cfg.stateFile)
+	}
 	prometheus.MustRegister(collector)
+	go runStateSaver(collector)
+	go runGraphitePusher()
+	go runOTLPPusher()
 
-	http.Handle("/metrics", promhttp.Handler())
+	http.Handle(metricsPath, allowClients(promhttp.Handler()))
+	http.HandleFunc("/ready", func(w http.ResponseWriter, r *http.Request) {
+		if !collector.ready() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintf(w, "Warming up: %d of %d consecutive successful scrapes.\n", collector.consecutiveSuccesses.Load(), currentConfig().warmupScrapes)
+			return
+		}
+		w.Write([]byte("Ready.\n"))
+	})
+	http.HandleFunc("/targets", serveTargets)
+	http.HandleFunc("/ha-discovery", serveHADiscovery)
+	http.HandleFunc("/lasterror", collector.serveLastError)
+	http.HandleFunc("/events", collector.serveEvents)
+	http.HandleFunc("/maintenance", serveMaintenance)
+	go reloadOnSIGHUP()
+	http.Handle("/-/reload", allowClients(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "Only POST requests allowed.", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := reloadConfig(); err != nil {
+			log.Printf("Error: Could not reload configuration: %v", err)
+			http.Error(w, fmt.Sprintf("Could not reload configuration: %v", err), http.StatusBadRequest)
+			return
+		}
+		log.Println("Configuration reloaded.")
+		w.Write([]byte("Configuration reloaded.\n"))
+	})))
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		w.Write([]byte(`
-			<html><head><title>Panasonic Exporter</title></head>
-			<body><h1>Panasonic Breaker Box Exporter</h1><p><a href="/metrics">Metrics</a></p></body>
-			</html>
-		`))
+		if currentConfig().protectLandingPage {
+			allowClients(http.HandlerFunc(serveLandingPage)).ServeHTTP(w, r)
+			return
+		}
+		serveLandingPage(w, r)
 	})
 
 	log.Printf("Exporter starting. Listening on address %s", listenAddress)
-	if err := http.ListenAndServe(listenAddress, nil); err != nil {
+	logBanner(currentConfig())
+	if err := serveUntilShutdown(&http.Server{Addr: listenAddress}); err != nil {
 		log.Fatalf("Error: Could not start HTTP server: %v", err)
 	}
 }
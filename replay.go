@@ -0,0 +1,53 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// replayStart is when the exporter started, from which the replayed file is
+// chosen when advancing on a timer.
+var replayStart = time.Now()
+
+// replayBody returns the contents of the file to replay from
+// PANASONIC_REPLAY_DIR instead of fetching from the breaker box. The CSV
+// files are replayed in the order of their names, so names starting with a
+// timestamp replay chronologically. The directory is listed on every call,
+// so files can be added while replaying.
+func (f *fetcher) replayBody(cfg *config) ([]byte, error) {
+	entries, err := os.ReadDir(cfg.replayDir)
+	if err != nil {
+		return nil, fmt.Errorf("could not read replay directory: %w", err)
+	}
+	var files []string
+	for _, entry := range entries {
+		if entry.Type().IsRegular() && strings.EqualFold(filepath.Ext(entry.Name()), ".csv") {
+			files = append(files, entry.Name())
+		}
+	}
+	if len(files) == 0 {
+		return nil, errors.New("replay directory contains no CSV files")
+	}
+
+	// Without an interval, the replay advances on every scrape.
+	var i int
+	if cfg.replayInterval > 0 {
+		i = int(time.Since(replayStart) / cfg.replayInterval)
+	} else {
+		i = f.replayIndex
+		f.replayIndex++
+	}
+	if i >= len(files) {
+		if cfg.replayLoop {
+			i %= len(files)
+		} else {
+			// Stopping keeps serving the last file.
+			i = len(files) - 1
+		}
+	}
+	return os.ReadFile(filepath.Join(cfg.replayDir, files[i]))
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// shutdownTimeout bounds how long in-flight requests may take to finish once
+// the server stops accepting connections.
+const shutdownTimeout = 10 * time.Second
+
+// draining is set once shutdown began. Fetches then serve the cached data
+// instead of contacting the breaker box.
+var draining atomic.Bool
+
+// errDraining is returned by fetches during shutdown when no data is cached.
+var errDraining = errors.New("exporter is shutting down and has no cached data")
+
+// serveUntilShutdown serves HTTP until the process receives SIGINT or
+// SIGTERM. It then keeps serving the last fetched data for the configured
+// drain period, so scrapes racing a rolling restart still get valid metrics,
+// before it stops accepting connections and waits for in-flight requests.
+func serveUntilShutdown(server *http.Server) error {
+	stopped := make(chan struct{})
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		<-signals
+
+		draining.Store(true)
+		if drain := currentConfig().shutdownDrain; drain > 0 {
+			log.Printf("Shutting down, serving cached data for %s.", drain)
+			time.Sleep(drain)
+		} else {
+			log.Println("Shutting down.")
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			log.Printf("Warning: in-flight requests did not finish: %v", err)
+		}
+		close(stopped)
+	}()
+
+	if err := server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	<-stopped
+	return nil
+}
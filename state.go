@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"slices"
+	"time"
+)
+
+// collectorState is the per-circuit state of the windowed computations that
+// is persisted to PANASONIC_STATE_FILE, so a restart does not reset it.
+type collectorState struct {
+	EWMA        map[string]float64          `json:"ewma"`
+	LastEmitted map[string]float64          `json:"last_emitted"`
+	LastChanges map[string]persistedChange  `json:"last_changes"`
+	Counters    map[string]persistedCounter `json:"counters"`
+
+	// CounterHistory holds the samples of the energy windows.
+	CounterHistory map[string][]persistedCounter `json:"counter_history"`
+
+	// Latencies holds the response latencies of the p95 window in seconds.
+	Latencies []float64 `json:"latencies"`
+}
+
+// persistedChange is the serialized form of circuitChange.
+type persistedChange struct {
+	Value     float64   `json:"value"`
+	ChangedAt time.Time `json:"changed_at"`
+}
+
+// persistedCounter is the serialized form of counterSample.
+type persistedCounter struct {
+	Value   float64   `json:"value"`
+	At      time.Time `json:"at"`
+	Rate    float64   `json:"rate"`
+	HasRate bool      `json:"has_rate"`
+}
+
+// persistCounter returns the serialized form of a counter sample.
+func persistCounter(sample counterSample) persistedCounter {
+	return persistedCounter{Value: sample.value, At: sample.at, Rate: sample.rate, HasRate: sample.hasRate}
+}
+
+// counterSample returns the counter sample p was serialized from.
+func (p persistedCounter) counterSample() counterSample {
+	return counterSample{value: p.Value, at: p.At, rate: p.Rate, hasRate: p.HasRate}
+}
+
+// loadState restores the state saved in path. A missing or corrupt file is
+// logged and the collector starts fresh.
+func (c *panasonicCollector) loadState(path string) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err != nil {
+		log.Printf("Warning: could not read state file, starting fresh: %v", err)
+		return
+	}
+	var state collectorState
+	if err := json.Unmarshal(data, &state); err != nil {
+		log.Printf("Warning: could not parse state file, starting fresh: %v", err)
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for key, value := range state.EWMA {
+		c.ewma[key] = value
+	}
+	for key, value := range state.LastEmitted {
+		c.lastEmitted[key] = value
+	}
+	for key, change := range state.LastChanges {
+		c.lastChanges[key] = circuitChange{value: change.Value, changedAt: change.ChangedAt}
+	}
+	for key, sample := range state.Counters {
+		c.lastCounters[key] = sample.counterSample()
+	}
+	for key, samples := range state.CounterHistory {
+		history := make([]counterSample, len(samples))
+		for i, sample := range samples {
+			history[i] = sample.counterSample()
+		}
+		c.counterHistory[key] = history
+	}
+	c.latencies = state.Latencies
+}
+
+// saveState writes the current state to path atomically.
+func (c *panasonicCollector) saveState(path string) error {
+	c.mutex.Lock()
+	state := collectorState{
+		EWMA:        make(map[string]float64, len(c.ewma)),
+		LastEmitted: make(map[string]float64, len(c.lastEmitted)),
+		LastChanges: make(map[string]persistedChange, len(c.lastChanges)),
+		Counters:    make(map[string]persistedCounter, len(c.lastCounters)),
+
+		CounterHistory: make(map[string][]persistedCounter, len(c.counterHistory)),
+		Latencies:      slices.Clone(c.latencies),
+	}
+	for key, value := range c.ewma {
+		state.EWMA[key] = value
+	}
+	for key, value := range c.lastEmitted {
+		state.LastEmitted[key] = value
+	}
+	for key, change := range c.lastChanges {
+		state.LastChanges[key] = persistedChange{Value: change.value, ChangedAt: change.changedAt}
+	}
+	for key, sample := range c.lastCounters {
+		state.Counters[key] = persistCounter(sample)
+	}
+	for key, history := range c.counterHistory {
+		samples := make([]persistedCounter, len(history))
+		for i, sample := range history {
+			samples[i] = persistCounter(sample)
+		}
+		state.CounterHistory[key] = samples
+	}
+	c.mutex.Unlock()
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data)
+}
+
+// runStateSaver periodically snapshots the state to PANASONIC_STATE_FILE. It
+// runs forever and picks up configuration changes on every iteration, doing
+// nothing while no state file is configured.
+func runStateSaver(c *panasonicCollector) {
+	for {
+		cfg := currentConfig()
+		time.Sleep(cfg.stateInterval)
+
+		cfg = currentConfig()
+		if cfg.stateFile == "" {
+			continue
+		}
+		if err := c.saveState(cfg.stateFile); err != nil {
+			log.Printf("Error: Could not save state: %v", err)
+		}
+	}
+}
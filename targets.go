@@ -0,0 +1,40 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+)
+
+// targetGroup is a target group in the Prometheus HTTP service discovery format.
+type targetGroup struct {
+	Targets []string          `json:"targets"`
+	Labels  map[string]string `json:"labels"`
+}
+
+// targetGroups lists the configured breaker box as an HTTP service discovery
+// target group. The target is the exporter itself, reached at host.
+func targetGroups(cfg *config, host string) []targetGroup {
+	box := cfg.breakerBoxURL
+	if u, err := url.Parse(box); err == nil && u.Host != "" {
+		box = u.Host
+	}
+	return []targetGroup{{
+		Targets: []string{host},
+		Labels: map[string]string{
+			"__metrics_path__": "/metrics",
+			"box":              box,
+		},
+	}}
+}
+
+// serveTargets serves the HTTP service discovery target groups if enabled.
+func serveTargets(w http.ResponseWriter, r *http.Request) {
+	cfg := currentConfig()
+	if !cfg.httpSD {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(targetGroups(cfg, r.Host))
+}
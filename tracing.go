@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+)
+
+// The types below model the subset of the OTLP/HTTP JSON encoding of
+// ExportTraceServiceRequest needed for the scrape traces. Unlike metric
+// attributes, span attributes can also hold integers and booleans.
+type (
+	otlpTraceRequest struct {
+		ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+	}
+	otlpResourceSpans struct {
+		Resource   otlpResource     `json:"resource"`
+		ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+	}
+	otlpScopeSpans struct {
+		Scope otlpScope  `json:"scope"`
+		Spans []otlpSpan `json:"spans"`
+	}
+	otlpSpan struct {
+		TraceID           string              `json:"traceId"`
+		SpanID            string              `json:"spanId"`
+		ParentSpanID      string              `json:"parentSpanId,omitempty"`
+		Name              string              `json:"name"`
+		Kind              int                 `json:"kind"`
+		StartTimeUnixNano string              `json:"startTimeUnixNano"`
+		EndTimeUnixNano   string              `json:"endTimeUnixNano"`
+		Attributes        []otlpSpanAttribute `json:"attributes,omitempty"`
+		Status            otlpStatus          `json:"status"`
+	}
+	otlpSpanAttribute struct {
+		Key   string       `json:"key"`
+		Value otlpAnyValue `json:"value"`
+	}
+	otlpAnyValue struct {
+		StringValue *string `json:"stringValue,omitempty"`
+		IntValue    *string `json:"intValue,omitempty"`
+		BoolValue   *bool   `json:"boolValue,omitempty"`
+	}
+	otlpStatus struct {
+		Code    int    `json:"code"`
+		Message string `json:"message,omitempty"`
+	}
+)
+
+// Span kinds and status codes used in the scrape traces.
+const (
+	otlpSpanInternal = 1
+	otlpSpanClient   = 3
+
+	otlpStatusOK    = 1
+	otlpStatusError = 2
+)
+
+// traceSpan is a span of a scrape trace being recorded. All methods are
+// no-ops on a nil span, so the scrape does not have to check whether tracing
+// is enabled.
+type traceSpan struct {
+	span  otlpSpan
+	start time.Time
+	trace *scrapeTrace
+}
+
+// scrapeTrace collects the spans of a single scrape.
+type scrapeTrace struct {
+	id    string
+	spans []*traceSpan
+}
+
+// startTrace starts the root span of a scrape trace, or returns nil if
+// tracing is disabled.
+func startTrace(cfg *config, name string) *traceSpan {
+	if !cfg.tracing {
+		return nil
+	}
+	trace := &scrapeTrace{id: randomID(16)}
+	return trace.start(name, "", otlpSpanInternal)
+}
+
+// start adds a span to the trace.
+func (t *scrapeTrace) start(name, parentID string, kind int) *traceSpan {
+	s := &traceSpan{
+		span: otlpSpan{
+			TraceID:      t.id,
+			SpanID:       randomID(8),
+			ParentSpanID: parentID,
+			Name:         name,
+			Kind:         kind,
+		},
+		start: time.Now(),
+		trace: t,
+	}
+	t.spans = append(t.spans, s)
+	return s
+}
+
+// child starts a span nested in s. Calls to the breaker box are client spans.
+func (s *traceSpan) child(name string, kind int) *traceSpan {
+	if s == nil {
+		return nil
+	}
+	return s.trace.start(name, s.span.SpanID, kind)
+}
+
+// set adds an attribute to the span. value must be a string, int or bool.
+func (s *traceSpan) set(key string, value any) {
+	if s == nil {
+		return
+	}
+	var v otlpAnyValue
+	switch value := value.(type) {
+	case string:
+		v.StringValue = &value
+	case int:
+		n := strconv.Itoa(value)
+		v.IntValue = &n
+	case bool:
+		v.BoolValue = &value
+	default:
+		panic(fmt.Sprintf("unsupported span attribute type %T", value))
+	}
+	s.span.Attributes = append(s.span.Attributes, otlpSpanAttribute{Key: key, Value: v})
+}
+
+// end ends the span, marking it as failed if err is not nil.
+func (s *traceSpan) end(err error) {
+	if s == nil {
+		return
+	}
+	s.span.StartTimeUnixNano = strconv.FormatInt(s.start.UnixNano(), 10)
+	s.span.EndTimeUnixNano = strconv.FormatInt(time.Now().UnixNano(), 10)
+	s.span.Status = otlpStatus{Code: otlpStatusOK}
+	if err != nil {
+		s.span.Status = otlpStatus{Code: otlpStatusError, Message: err.Error()}
+	}
+}
+
+// export ends the root span s and sends the whole trace to the configured
+// endpoint in the background, so a slow collector does not delay the scrape.
+// Spans that were never ended, e.g. because the scrape failed before them,
+// are left out.
+func (s *traceSpan) export(cfg *config, err error) {
+	if s == nil {
+		return
+	}
+	s.end(err)
+	var spans []otlpSpan
+	for _, span := range s.trace.spans {
+		if span.span.EndTimeUnixNano != "" {
+			spans = append(spans, span.span)
+		}
+	}
+	go func() {
+		if err := pushTrace(cfg.tracingEndpoint, spans); err != nil {
+			log.Printf("Error: Could not push trace to %s: %v", cfg.tracingEndpoint, err)
+		}
+	}()
+}
+
+// pushTrace sends spans in a single request, with the namespace as
+// instrumentation scope.
+func pushTrace(endpoint string, spans []otlpSpan) error {
+	body, err := json.Marshal(otlpTraceRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource: otlpResource{Attributes: []otlpAttribute{
+			{Key: "service.name", Value: otlpAttrString{"panasonic-exporter"}},
+		}},
+		ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{Name: namespace}, Spans: spans}},
+	}}})
+	if err != nil {
+		return err
+	}
+
+	resp, err := otlpClient.Post(endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("received non-2xx status code: %s", resp.Status)
+	}
+	return nil
+}
+
+// randomID returns n random bytes in hex, as used for trace and span IDs.
+func randomID(n int) string {
+	id := make([]byte, n)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}